@@ -1,15 +1,36 @@
 package dolly
 
 import (
+	"context"
 	"fmt"
 	"time"
 
 	zmq "github.com/pebbe/zmq4"
 )
 
+// Reliability settings for client requests in the Lazy Pirate pattern. Each
+// attempt waits for a reply for the request timeout, after which the socket
+// is reconnected and the request is resent after an exponential backoff until
+// the retries are exhausted or the context is done. Note that a retried Put
+// may be applied more than once if only its reply was lost.
+const (
+	RequestTimeout = 1 * time.Second
+	RequestRetries = 3
+	RequestBackoff = 100 * time.Millisecond
+)
+
+// How often the client checks if the context is done while waiting.
+const pollInterval = 50 * time.Millisecond
+
+// Version of a value is the sequence of the state in which it was written.
+type Version uint64
+
 // Client connects to the a replica and makes requests.
 type Client struct {
 	replica *Replica
+	retries int
+	public  string
+	secret  string
 	context *zmq.Context
 	socket  *zmq.Socket
 }
@@ -20,21 +41,53 @@ func (c *Client) Connect() (err error) {
 		return err
 	}
 
+	return c.dial()
+}
+
+// Close all sockets on the client and stop resonding to requests.
+func (c *Client) Close() error {
+	if c.socket != nil {
+		if err := c.socket.Close(); err != nil {
+			return err
+		}
+		c.socket = nil
+	}
+	return c.context.Term()
+}
+
+// Create the socket and connect it to the replica, closing the previous socket
+// so that no replies to abandoned requests are received on the new one.
+func (c *Client) dial() (err error) {
+	if c.socket != nil {
+		if err = c.socket.Close(); err != nil {
+			return err
+		}
+	}
+
 	if c.socket, err = c.context.NewSocket(zmq.DEALER); err != nil {
 		return err
 	}
 
-	endpoint := fmt.Sprintf("tcp://%s:%d", c.replica.Addr, c.replica.Requests)
-	return c.socket.Connect(endpoint)
+	if err = c.socket.SetLinger(0); err != nil {
+		return err
+	}
+
+	if err = c.curve(c.socket); err != nil {
+		return err
+	}
+
+	return c.socket.Connect(c.endpoint())
 }
 
-// Close all sockets on the client and stop resonding to requests.
-func (c *Client) Close() error {
-	return zmq.Term()
+// The endpoint of the requests socket of the replica.
+func (c *Client) endpoint() string {
+	return fmt.Sprintf("tcp://%s:%d", c.replica.Addr, c.replica.Requests)
 }
 
-// Get the value for the specified key
-func (c *Client) Get(key string, timeout time.Duration) error {
+// Get the value and version for the specified key. Returns ErrNotFound if the
+// key does not exist on the replica. Options such as WithConsistency can be
+// specified to read fresher state than the replica currently has.
+func (c *Client) Get(ctx context.Context, key string, opts ...Option) ([]byte, Version, error) {
 	msg := &Message{
 		method:   MethodGet,
 		sequence: 0,
@@ -42,46 +95,189 @@ func (c *Client) Get(key string, timeout time.Duration) error {
 		body:     nil,
 	}
 
-	if err := msg.Send(c.socket, nil); err != nil {
-		return err
+	rep, err := c.request(ctx, msg.apply(opts))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return rep.body, Version(rep.sequence), nil
+}
+
+// Put a value for the specified key, returning the version it was written
+// in. Replicas forward the write to the leader, but return ErrNotLeader if
+// the leader is being elected. Options such as WithTTL can be specified; if
+// WithWriteConcern is specified and not enough replicas apply the write in
+// time, ErrUnacknowledged is returned along with the version it was written in.
+func (c *Client) Put(ctx context.Context, key string, val []byte, opts ...Option) (Version, error) {
+	msg := &Message{
+		method:   MethodPut,
+		sequence: 0,
+		key:      key,
+		body:     val,
 	}
 
-	rep, _, err := RecvMessage(c.socket, false)
+	rep, err := c.request(ctx, msg.apply(opts))
+	if err == ErrUnacknowledged {
+		return Version(rep.sequence), err
+	}
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	if rep.method == MethodError {
-		fmt.Printf("could not get %s: %s\n", rep.key, string(rep.body))
-	} else {
-		fmt.Printf("%s = %s (state %d)\n", rep.key, string(rep.body), rep.sequence)
+	return Version(rep.sequence), nil
+}
+
+// CompareAndSwap puts a value for the specified key only if the current
+// version of the key matches the expected version, returning the version it
+// was written in. If the expected version is zero, the value is only put if
+// the key does not exist. If the versions do not match, ErrConflict is
+// returned along with the current version of the key.
+func (c *Client) CompareAndSwap(ctx context.Context, key string, expected Version, val []byte, opts ...Option) (Version, error) {
+	msg := &Message{
+		method:   MethodCAS,
+		sequence: uint64(expected),
+		key:      key,
+		body:     val,
 	}
 
-	return nil
+	rep, err := c.request(ctx, msg.apply(opts))
+	if err == ErrConflict || err == ErrUnacknowledged {
+		return Version(rep.sequence), err
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return Version(rep.sequence), nil
+}
+
+// Txn applies the puts and deletes of the transaction atomically, returning
+// the version they were written in. If a check in the transaction fails,
+// ErrConflict is returned along with the current version of the checked key.
+func (c *Client) Txn(ctx context.Context, txn *Txn, opts ...Option) (Version, error) {
+	msg, err := txn.message()
+	if err != nil {
+		return 0, err
+	}
+
+	rep, err := c.request(ctx, msg.apply(opts))
+	if err == ErrConflict || err == ErrUnacknowledged {
+		return Version(rep.sequence), err
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return Version(rep.sequence), nil
 }
 
-// Put a value for the specified key.
-func (c *Client) Put(key, val string, timeout time.Duration) error {
+// Delete the value for the specified key, returning the version it was
+// deleted in. Returns ErrNotFound if the key does not exist.
+func (c *Client) Delete(ctx context.Context, key string, opts ...Option) (Version, error) {
 	msg := &Message{
-		method:   MethodPut,
+		method:   MethodDelete,
 		sequence: 0,
 		key:      key,
-		body:     []byte(val),
+		body:     nil,
 	}
 
-	if err := msg.Send(c.socket, nil); err != nil {
-		return err
+	rep, err := c.request(ctx, msg.apply(opts))
+	if err == ErrUnacknowledged {
+		return Version(rep.sequence), err
 	}
-
-	rep, _, err := RecvMessage(c.socket, false)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	if rep.method == MethodError {
-		fmt.Printf("could not put %s: %s\n", rep.key, string(rep.body))
-	} else {
-		fmt.Printf("%s set in state %d\n", rep.key, rep.sequence)
+	return Version(rep.sequence), nil
+}
+
+// Send a request to the replica and wait for the reply, decoding any error
+// that is sent back by the replica (the error reply is also returned). If no
+// reply arrives in the request timeout the socket is reconnected and the
+// request retried up to the number of retries of the client. Returns
+// ErrTimeout if the retries are exhausted or the deadline of the context
+// passes.
+func (c *Client) request(ctx context.Context, msg *Message) (*Message, error) {
+	backoff := RequestBackoff
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, contextError(ctx.Err())
+			case <-time.After(backoff):
+				backoff *= 2
+			}
+
+			debug("no reply from %s, retrying %s (attempt %d)", c.replica.Name, msg.method, attempt)
+			if err := c.dial(); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, contextError(err)
+		}
+
+		if err := msg.Send(c.socket, nil); err != nil {
+			if zmq.AsErrno(err) == zmq.EAGAIN {
+				continue
+			}
+			return nil, err
+		}
+
+		rep, err := c.recv(ctx)
+		if err == ErrTimeout {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if rep.method == MethodError {
+			return rep, decodeError(rep)
+		}
+		return rep, nil
+	}
+
+	return nil, ErrTimeout
+}
+
+// Wait for a reply until the request timeout elapses or the context is done.
+func (c *Client) recv(ctx context.Context) (*Message, error) {
+	poller := zmq.NewPoller()
+	poller.Add(c.socket, zmq.POLLIN)
+
+	deadline := time.Now().Add(RequestTimeout)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, contextError(err)
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil, ErrTimeout
+		}
+		if wait > pollInterval {
+			wait = pollInterval
+		}
+
+		items, err := poller.Poll(wait)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(items) > 0 {
+			rep, _, err := RecvMessage(c.socket, false)
+			return rep, err
+		}
+	}
+}
+
+// Convert an exceeded context deadline into a timeout.
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return ErrTimeout
 	}
-	return nil
+	return err
 }
@@ -0,0 +1,182 @@
+package dolly
+
+import (
+	"context"
+	"time"
+)
+
+// Cluster is a client that connects to every replica in the network. Writes
+// are sent to the leader and reads are spread across the replicas in round
+// robin order. If a replica stops responding, the request fails over to the
+// next replica; the leader is learned from the replies to writes and from the
+// leader named in error replies.
+type Cluster struct {
+	clients []*Client // clients for every replica ordered by PID
+	leader  int       // index of the client of the last known leader
+	next    int       // index of the client to send the next read to
+}
+
+// Connect to every replica in the network.
+func (c *Cluster) Connect() error {
+	for _, client := range c.clients {
+		if err := client.Connect(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close the connections to every replica.
+func (c *Cluster) Close() error {
+	for _, client := range c.clients {
+		if err := client.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the value and version for the specified key from the next replica,
+// failing over to the other replicas if it does not respond. See Client.Get
+// for the options that can be specified.
+func (c *Cluster) Get(ctx context.Context, key string, opts ...Option) ([]byte, Version, error) {
+	msg := &Message{
+		method:   MethodGet,
+		sequence: 0,
+		key:      key,
+		body:     nil,
+	}
+
+	start := c.next
+	c.next = (c.next + 1) % len(c.clients)
+
+	rep, err := c.request(ctx, msg.apply(opts), start)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return rep.body, Version(rep.sequence), nil
+}
+
+// Put a value for the specified key on the leader, returning the version it
+// was written in. Options such as WithTTL can be specified.
+func (c *Cluster) Put(ctx context.Context, key string, val []byte, opts ...Option) (Version, error) {
+	msg := &Message{
+		method:   MethodPut,
+		sequence: 0,
+		key:      key,
+		body:     val,
+	}
+
+	return c.write(ctx, msg.apply(opts))
+}
+
+// CompareAndSwap puts a value for the specified key on the leader only if the
+// current version of the key matches the expected version. See
+// Client.CompareAndSwap for details.
+func (c *Cluster) CompareAndSwap(ctx context.Context, key string, expected Version, val []byte, opts ...Option) (Version, error) {
+	msg := &Message{
+		method:   MethodCAS,
+		sequence: uint64(expected),
+		key:      key,
+		body:     val,
+	}
+
+	return c.write(ctx, msg.apply(opts))
+}
+
+// Txn applies the puts and deletes of the transaction atomically on the
+// leader. See Client.Txn for details.
+func (c *Cluster) Txn(ctx context.Context, txn *Txn, opts ...Option) (Version, error) {
+	msg, err := txn.message()
+	if err != nil {
+		return 0, err
+	}
+
+	return c.write(ctx, msg.apply(opts))
+}
+
+// Delete the value for the specified key on the leader, returning the version
+// it was deleted in.
+func (c *Cluster) Delete(ctx context.Context, key string, opts ...Option) (Version, error) {
+	msg := &Message{
+		method:   MethodDelete,
+		sequence: 0,
+		key:      key,
+		body:     nil,
+	}
+
+	return c.write(ctx, msg.apply(opts))
+}
+
+// Send a write to the leader, returning the version it was written in (even
+// if the write conflicted or was not acknowledged by enough replicas).
+func (c *Cluster) write(ctx context.Context, msg *Message) (Version, error) {
+	rep, err := c.leaderRequest(ctx, msg)
+	if err == ErrConflict || err == ErrUnacknowledged {
+		return Version(rep.sequence), err
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return Version(rep.sequence), nil
+}
+
+// Send a request to the leader. If the leader does not respond, the request
+// is sent to the replicas in PID order (which forward it to the leader) since
+// the replica with the next lowest PID will be elected. The name of the leader
+// is learned from the reply.
+func (c *Cluster) leaderRequest(ctx context.Context, msg *Message) (*Message, error) {
+	rep, err := c.request(ctx, msg, c.leader)
+	if err != nil {
+		return rep, err
+	}
+
+	c.learn(string(rep.body))
+	return rep, nil
+}
+
+// Update the last known leader to the named replica, if it is a peer.
+func (c *Cluster) learn(name string) {
+	for i, client := range c.clients {
+		if client.replica.Name == name {
+			c.leader = i
+			return
+		}
+	}
+}
+
+// Send the request to each replica in turn beginning with the client at the
+// start index until one of them replies. Replicas that do not respond, that
+// are electing a leader, or that do not hold the key are skipped. If no
+// replica replies, the clients are retried after a backoff until the context
+// is done. The leader named in error replies is learned for later writes.
+func (c *Cluster) request(ctx context.Context, msg *Message, start int) (rep *Message, err error) {
+	backoff := RequestBackoff
+	for attempt := 0; attempt <= RequestRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, contextError(ctx.Err())
+			case <-time.After(backoff):
+				backoff *= 2
+			}
+		}
+
+		for i := range c.clients {
+			client := c.clients[(start+i)%len(c.clients)]
+			rep, err = client.request(ctx, msg)
+			if rep != nil && rep.method == MethodError {
+				c.learn(rep.options.Get(optLeader))
+			}
+			if err == ErrTimeout || err == ErrNotLeader || err == ErrNotReplicated {
+				debug("%s could not handle %s: %s", client.replica.Name, msg.method, err)
+				continue
+			}
+			return rep, err
+		}
+	}
+
+	return nil, err
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/bbengfort/dolly"
@@ -59,6 +62,12 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:     "keygen",
+			Usage:    "generate a CURVE keypair for a replica or client",
+			Category: "server",
+			Action:   keygen,
+		},
 		{
 			Name:     "get",
 			Usage:    "get a value for the specified key(s)",
@@ -73,13 +82,22 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:   "n, name",
-					Usage:  "name of the replica to connect to",
+					Usage:  "name of the replica to connect to (default all replicas)",
 					Value:  "",
 					EnvVar: "KILO_LEADER_NAME",
 				},
+				cli.StringFlag{
+					Name:  "c, consistency",
+					Usage: "read consistency of stale or linearizable",
+					Value: string(dolly.ReadStale),
+				},
+				cli.UintFlag{
+					Name:  "m, min",
+					Usage: "wait until the replica has applied the specified state",
+				},
 				cli.StringFlag{
 					Name:   "t, timeout",
-					Usage:  "recv timeout for each message",
+					Usage:  "timeout for each request including retries",
 					Value:  "2s",
 					EnvVar: "KILO_TIMEOUT",
 				},
@@ -99,13 +117,147 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:   "n, name",
-					Usage:  "name of the replica to connect to",
+					Usage:  "name of the replica to connect to (default all replicas)",
+					Value:  "",
+					EnvVar: "KILO_LEADER_NAME",
+				},
+				cli.StringFlag{
+					Name:  "e, ttl",
+					Usage: "parsable duration after which the key expires",
+				},
+				cli.StringFlag{
+					Name:  "w, concern",
+					Usage: "write concern of leader, majority, or all replicas",
+					Value: string(dolly.WriteLeader),
+				},
+				cli.StringFlag{
+					Name:   "t, timeout",
+					Usage:  "timeout for each request including retries",
+					Value:  "2s",
+					EnvVar: "KILO_TIMEOUT",
+				},
+			},
+		},
+		{
+			Name:     "del",
+			Usage:    "delete the value for the specified key(s)",
+			Category: "client",
+			Action:   del,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "p, peers",
+					Usage:  "path to peers configuration",
+					Value:  "",
+					EnvVar: "PEERS_PATH",
+				},
+				cli.StringFlag{
+					Name:   "n, name",
+					Usage:  "name of the replica to connect to (default all replicas)",
+					Value:  "",
+					EnvVar: "KILO_LEADER_NAME",
+				},
+				cli.StringFlag{
+					Name:  "w, concern",
+					Usage: "write concern of leader, majority, or all replicas",
+					Value: string(dolly.WriteLeader),
+				},
+				cli.StringFlag{
+					Name:   "t, timeout",
+					Usage:  "timeout for each request including retries",
+					Value:  "2s",
+					EnvVar: "KILO_TIMEOUT",
+				},
+			},
+		},
+		{
+			Name:      "scan",
+			Usage:     "list the keys with the specified prefix in order",
+			Category:  "client",
+			ArgsUsage: "[prefix]",
+			Action:    scan,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "p, peers",
+					Usage:  "path to peers configuration",
+					Value:  "",
+					EnvVar: "PEERS_PATH",
+				},
+				cli.StringFlag{
+					Name:   "n, name",
+					Usage:  "name of the replica to connect to (default all replicas)",
 					Value:  "",
 					EnvVar: "KILO_LEADER_NAME",
 				},
+				cli.StringFlag{
+					Name:  "s, start",
+					Usage: "first key of the range to scan",
+				},
+				cli.StringFlag{
+					Name:  "e, end",
+					Usage: "key to end the range before",
+				},
+				cli.IntFlag{
+					Name:  "l, limit",
+					Usage: "maximum number of keys to list",
+					Value: dolly.DefaultScanLimit,
+				},
+				cli.StringFlag{
+					Name:  "c, cursor",
+					Usage: "list the keys after the cursor of a previous scan",
+				},
 				cli.StringFlag{
 					Name:   "t, timeout",
-					Usage:  "recv timeout for each message",
+					Usage:  "timeout for each request including retries",
+					Value:  "2s",
+					EnvVar: "KILO_TIMEOUT",
+				},
+			},
+		},
+		{
+			Name:      "watch",
+			Usage:     "stream changes to the keys with the specified prefix",
+			Category:  "client",
+			ArgsUsage: "[prefix]",
+			Action:    watch,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "p, peers",
+					Usage:  "path to peers configuration",
+					Value:  "",
+					EnvVar: "PEERS_PATH",
+				},
+				cli.StringFlag{
+					Name:   "n, name",
+					Usage:  "name of the replica to connect to (default all replicas)",
+					Value:  "",
+					EnvVar: "KILO_LEADER_NAME",
+				},
+				cli.UintFlag{
+					Name:  "f, from",
+					Usage: "replay changes after the specified state",
+				},
+				cli.StringFlag{
+					Name:  "t, timeout",
+					Usage: "stop streaming after the duration, or when interrupted if zero",
+					Value: "0s",
+				},
+			},
+		},
+		{
+			Name:     "status",
+			Usage:    "print the status of every replica in the cluster",
+			Category: "client",
+			Action:   status,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "p, peers",
+					Usage:  "path to peers configuration",
+					Value:  "",
+					EnvVar: "PEERS_PATH",
+				},
+				cli.StringFlag{
+					Name:   "t, timeout",
+					Usage:  "timeout for the status requests",
 					Value:  "2s",
 					EnvVar: "KILO_TIMEOUT",
 				},
@@ -128,6 +280,51 @@ func exit(err error) error {
 	return nil
 }
 
+// Client is implemented by both a client to a single replica and a client to
+// the entire cluster.
+type client interface {
+	Get(ctx context.Context, key string, opts ...dolly.Option) ([]byte, dolly.Version, error)
+	Put(ctx context.Context, key string, val []byte, opts ...dolly.Option) (dolly.Version, error)
+	Delete(ctx context.Context, key string, opts ...dolly.Option) (dolly.Version, error)
+	Scan(ctx context.Context, opts ...dolly.Option) ([]*dolly.KeyValue, string, error)
+	Watch(ctx context.Context, prefix string, from dolly.Version) (<-chan *dolly.Event, error)
+	Close() error
+}
+
+// Connect a client to the replica specified by the command line flags, or to
+// the entire cluster if no replica is specified, and parse the timeout for
+// each request.
+func connect(c *cli.Context) (client, time.Duration, error) {
+	network, err := dolly.New(c.String("peers"))
+	if err != nil {
+		return nil, 0, err
+	}
+	network.SetKeypair(os.Getenv("DOLLY_PUBLIC_KEY"), os.Getenv("DOLLY_SECRET_KEY"))
+
+	timeout, err := time.ParseDuration(c.String("timeout"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if name := c.String("name"); name != "" {
+		replica, err := network.Client(name)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if err = replica.Connect(); err != nil {
+			return nil, 0, err
+		}
+		return replica, timeout, nil
+	}
+
+	cluster := network.Cluster()
+	if err = cluster.Connect(); err != nil {
+		return nil, 0, err
+	}
+	return cluster, timeout, nil
+}
+
 //===========================================================================
 // Server Commands
 //===========================================================================
@@ -163,67 +360,193 @@ func serve(c *cli.Context) error {
 	return nil
 }
 
+func keygen(c *cli.Context) error {
+	public, secret, err := zmq4.NewCurveKeypair()
+	if err != nil {
+		return exit(err)
+	}
+
+	fmt.Printf("\"public_key\": %q,\n\"secret_key\": %q\n", public, secret)
+	return nil
+}
+
 //===========================================================================
 // Client Commands
 //===========================================================================
 
 func get(c *cli.Context) error {
-	network, err := dolly.New(c.String("peers"))
+	client, timeout, err := connect(c)
 	if err != nil {
 		return exit(err)
 	}
 
-	client, err := network.Client(c.String("name"))
+	opts := []dolly.Option{dolly.WithConsistency(dolly.ReadConsistency(c.String("consistency")))}
+	if min := c.Uint("min"); min > 0 {
+		opts = append(opts, dolly.WithMinVersion(dolly.Version(min)))
+	}
+
+	for _, key := range c.Args() {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		val, version, err := client.Get(ctx, key, opts...)
+		cancel()
+
+		if err != nil {
+			fmt.Printf("could not get %s: %s\n", key, err)
+		} else {
+			fmt.Printf("%s = %s (state %d)\n", key, val, version)
+		}
+	}
+
+	return exit(client.Close())
+}
+
+func put(c *cli.Context) error {
+	client, timeout, err := connect(c)
 	if err != nil {
 		return exit(err)
 	}
 
-	if err = client.Connect(); err != nil {
-		return exit(err)
+	args := c.Args()
+	if len(args) != 2 {
+		return cli.NewExitError("specify the key then the value to put", 1)
 	}
 
-	var timeout time.Duration
-	if timeout, err = time.ParseDuration(c.String("timeout")); err != nil {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	opts := []dolly.Option{dolly.WithWriteConcern(dolly.WriteConcern(c.String("concern")))}
+	if ttl := c.String("ttl"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return exit(err)
+		}
+		opts = append(opts, dolly.WithTTL(d))
+	}
+
+	version, err := client.Put(ctx, args[0], []byte(args[1]), opts...)
+	if err != nil {
+		fmt.Printf("could not put %s: %s\n", args[0], err)
+	} else {
+		fmt.Printf("%s set in state %d\n", args[0], version)
+	}
+
+	return exit(client.Close())
+}
+
+func del(c *cli.Context) error {
+	client, timeout, err := connect(c)
+	if err != nil {
 		return exit(err)
 	}
 
 	for _, key := range c.Args() {
-		if err := client.Get(key, timeout); err != nil {
-			return exit(err)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		version, err := client.Delete(ctx, key, dolly.WithWriteConcern(dolly.WriteConcern(c.String("concern"))))
+		cancel()
+
+		if err != nil {
+			fmt.Printf("could not delete %s: %s\n", key, err)
+		} else {
+			fmt.Printf("%s deleted in state %d\n", key, version)
 		}
 	}
 
 	return exit(client.Close())
 }
 
-func put(c *cli.Context) error {
-	network, err := dolly.New(c.String("peers"))
+func scan(c *cli.Context) error {
+	client, timeout, err := connect(c)
 	if err != nil {
 		return exit(err)
 	}
 
-	client, err := network.Client(c.String("name"))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	opts := []dolly.Option{
+		dolly.WithPrefix(c.Args().First()),
+		dolly.WithRange(c.String("start"), c.String("end")),
+		dolly.WithLimit(c.Int("limit")),
+	}
+	if cursor := c.String("cursor"); cursor != "" {
+		opts = append(opts, dolly.WithCursor(cursor))
+	}
+
+	kvs, cursor, err := client.Scan(ctx, opts...)
+	if err != nil {
+		fmt.Printf("could not scan: %s\n", err)
+		return exit(client.Close())
+	}
+
+	for _, kv := range kvs {
+		fmt.Printf("%s = %s (state %d)\n", kv.Key, kv.Value, kv.Version)
+	}
+	if cursor != "" {
+		fmt.Printf("more keys after %s, continue with --cursor %q\n", cursor, cursor)
+	}
+
+	return exit(client.Close())
+}
+
+func watch(c *cli.Context) error {
+	client, timeout, err := connect(c)
 	if err != nil {
 		return exit(err)
 	}
 
-	if err = client.Connect(); err != nil {
+	// Stream changes until the timeout or the user interrupts the command
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	events, err := client.Watch(ctx, c.Args().First(), dolly.Version(c.Uint("from")))
+	if err != nil {
+		cancel()
 		return exit(err)
 	}
 
-	var timeout time.Duration
-	if timeout, err = time.ParseDuration(c.String("timeout")); err != nil {
+	for event := range events {
+		if event.Method == dolly.MethodDelete {
+			fmt.Printf("%s deleted in state %d\n", event.Key, event.Version)
+		} else {
+			fmt.Printf("%s = %s (state %d)\n", event.Key, event.Value, event.Version)
+		}
+	}
+
+	cancel()
+	return exit(client.Close())
+}
+
+func status(c *cli.Context) error {
+	network, err := dolly.New(c.String("peers"))
+	if err != nil {
 		return exit(err)
 	}
+	network.SetKeypair(os.Getenv("DOLLY_PUBLIC_KEY"), os.Getenv("DOLLY_SECRET_KEY"))
 
-	args := c.Args()
-	if len(args) != 2 {
-		return cli.NewExitError("specify the key then the value to put", 1)
+	timeout, err := time.ParseDuration(c.String("timeout"))
+	if err != nil {
+		return exit(err)
 	}
 
-	if err := client.Put(args[0], args[1], timeout); err != nil {
+	cluster := network.Cluster()
+	if err = cluster.Connect(); err != nil {
 		return exit(err)
 	}
 
-	return exit(client.Close())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	fmt.Print(cluster.Status(ctx))
+	return exit(cluster.Close())
 }
@@ -0,0 +1,146 @@
+// This file implements write concerns, where the leader holds the reply to a
+// write until enough replicas have acknowledged that they applied it.
+
+package dolly
+
+import (
+	"time"
+)
+
+// WriteConcern is the number of replicas that must apply a write before the
+// leader replies to the client.
+type WriteConcern string
+
+// Write concerns that can be requested with WithWriteConcern. Only replicas
+// that hold the entire store are counted, and the leader counts toward a
+// majority.
+const (
+	WriteLeader   WriteConcern = "leader"   // reply once the leader has applied the write
+	WriteMajority WriteConcern = "majority" // reply once a majority of replicas have applied it
+	WriteAll      WriteConcern = "all"      // reply once every replica has applied it
+)
+
+// AckTimeout is how long the leader holds the reply to a write waiting for
+// acks before replying with ErrUnacknowledged. It is less than the request
+// timeout so that clients do not resend the write while the reply is held.
+const AckTimeout = RequestTimeout / 2
+
+// WithWriteConcern holds the reply to a write until enough replicas have
+// applied it. The default is WriteLeader.
+func WithWriteConcern(concern WriteConcern) Option {
+	return func(m *Message) {
+		m.set(optConcern, string(concern))
+	}
+}
+
+// held is the reply to a write held until enough replicas have acked it.
+type held struct {
+	reply    *Message  // the reply to send to the client
+	route    [][]byte  // the route of the client
+	acks     int       // the number of acks needed
+	deadline time.Time // when to give up waiting for the acks
+}
+
+// Returns the number of replicas other than the leader that must ack a write
+// with the concern, or an error if the concern is not known.
+func (l *Leader) quorum(concern WriteConcern) (int, error) {
+	replicas := 0
+	for _, peer := range l.network.peers {
+		if peer != l.Replica && !peer.partial() {
+			replicas++
+		}
+	}
+
+	switch concern {
+	case "", WriteLeader:
+		return 0, nil
+	case WriteMajority:
+		return (replicas + 1) / 2, nil
+	case WriteAll:
+		return replicas, nil
+	default:
+		return 0, protocolErrorf("unknown write concern %q", concern)
+	}
+}
+
+// Returns the number of replicas other than the leader that have applied the
+// state, according to their latest acks and pings.
+func (l *Leader) acked(sequence uint64) int {
+	acks := 0
+	for _, peer := range l.network.peers {
+		if peer == l.Replica || peer.partial() {
+			continue
+		}
+
+		if member, ok := l.members[peer.Name]; ok && member.Sequence >= sequence {
+			acks++
+		}
+	}
+	return acks
+}
+
+// Handle an ack from a replica of the latest state it has applied, which also
+// lets the leader know that it is alive, and send any replies it completes.
+func (l *Leader) onAck(msg *Message) error {
+	if err := l.onPing(msg); err != nil {
+		return err
+	}
+	return l.settle()
+}
+
+// Send the held replies whose writes have been acked by enough replicas, or
+// an ErrUnacknowledged error with the state of the write if they time out.
+func (l *Leader) settle() error {
+	held := l.held[:0]
+	for _, h := range l.held {
+		if l.acked(h.reply.sequence) >= h.acks {
+			if err := l.respond(h.reply, h.route); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if time.Now().After(h.deadline) {
+			warn("write %d was not acknowledged by %d replicas in %s", h.reply.sequence, h.acks, AckTimeout)
+			rep := &Message{
+				method:   MethodError,
+				sequence: h.reply.sequence,
+				term:     h.reply.term,
+				key:      h.reply.key,
+				body:     []byte(ErrUnacknowledged.Error()),
+			}
+			if err := l.respond(rep, h.route); err != nil {
+				return err
+			}
+			continue
+		}
+
+		held = append(held, h)
+	}
+
+	l.held = held
+	return nil
+}
+
+//===========================================================================
+// Replica acks
+//===========================================================================
+
+// Ack the latest state applied to the leader if it has not been acked yet.
+// Acks are sent at most once per poll so that a burst of updates is acked
+// together.
+func (r *Replica) ack() error {
+	if r.electing || r.snapshots == nil || r.sequence <= r.acked {
+		return nil
+	}
+
+	r.acked = r.sequence
+	ack := &Message{
+		method:   MethodAck,
+		sequence: r.sequence,
+		term:     r.term,
+		key:      r.Name,
+		body:     nil,
+	}
+	return ack.Send(r.snapshots, nil)
+}
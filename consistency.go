@@ -0,0 +1,246 @@
+// This file implements the consistency of reads, which can wait until the
+// replica has applied a minimum state or the state of the leader.
+
+package dolly
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ReadConsistency is how fresh a read must be when it is served by a replica.
+type ReadConsistency string
+
+// Read consistencies that can be requested with WithConsistency.
+const (
+	ReadStale        ReadConsistency = "stale"        // serve the local state of the replica
+	ReadLinearizable ReadConsistency = "linearizable" // wait until the replica has the state of the leader
+)
+
+// ReadTimeout is how long a replica holds a read waiting for its state before
+// replying with ErrTimeout, which is the AckTimeout for the same reason.
+const ReadTimeout = AckTimeout
+
+// The index of a linearizable read of the leader held until it confirms that
+// it is still the leader.
+const confirming = "confirm"
+
+// WithConsistency sets the consistency of a read. Linearizable reads ask the
+// leader for its current state and wait until the replica has applied it, so
+// that the read reflects every write that was replied to before it was made.
+// The leader only replies once a majority of the replicas have confirmed that
+// it is still the leader. The default is ReadStale.
+func WithConsistency(consistency ReadConsistency) Option {
+	return func(m *Message) {
+		m.set(optConsistency, string(consistency))
+	}
+}
+
+// WithMinVersion holds a read until the replica has applied the version, for
+// example the version returned by a write so that the client reads it.
+func WithMinVersion(version Version) Option {
+	return func(m *Message) {
+		m.set(optMinSequence, strconv.FormatUint(uint64(version), 10))
+	}
+}
+
+// read is a Get or Scan held until the replica has applied its minimum state.
+type read struct {
+	msg      *Message  // the read request
+	route    [][]byte  // the route of the client
+	min      uint64    // the state the replica must apply to serve the read
+	index    string    // the id of the read index request to the leader, if any
+	started  time.Time // when the read was received
+	deadline time.Time // when to give up waiting for the state
+}
+
+// Handle a Get or Scan request, serving it once the replica has applied the
+// state required by its consistency.
+func (r *Replica) onRead(msg *Message, route [][]byte) (err error) {
+	now := time.Now()
+	rd := &read{msg: msg, route: route, started: now, deadline: now.Add(ReadTimeout)}
+
+	if val := msg.options.Get(optMinSequence); val != "" {
+		if rd.min, err = strconv.ParseUint(val, 10, 64); err != nil {
+			return r.sendError(r.requests, route, msg.key, protocolErrorf("bad min sequence %q", val))
+		}
+	}
+
+	switch ReadConsistency(msg.options.Get(optConsistency)) {
+	case "", ReadStale:
+	case ReadLinearizable:
+		if r.electing || r.snapshots == nil {
+			return r.sendError(r.requests, route, msg.key, ErrNotLeader)
+		}
+
+		// The leader has every state, but a deposed leader that has not heard
+		// of the new leader does not, so it must confirm its leadership
+		if r.network.leader == r {
+			rd.index = confirming
+		} else if err = r.readIndex(rd); err != nil {
+			return err
+		}
+	default:
+		return r.sendError(r.requests, route, msg.key, protocolErrorf("unknown read consistency %q", msg.options.Get(optConsistency)))
+	}
+
+	r.reads = append(r.reads, rd)
+	return r.answer()
+}
+
+// Ask the leader for its current state, which the read must wait for.
+func (r *Replica) readIndex(rd *read) error {
+	r.indexes++
+	rd.index = strconv.FormatUint(r.indexes, 10)
+
+	req := &Message{
+		method:   MethodReadIndex,
+		sequence: r.sequence,
+		term:     r.term,
+		key:      rd.index,
+		body:     nil,
+	}
+	return req.Send(r.snapshots, nil)
+}
+
+// Handle the reply from the leader to a read index request with its state.
+func (r *Replica) onReadIndex(msg *Message) error {
+	for _, rd := range r.reads {
+		if rd.index == msg.key {
+			rd.index = ""
+			if msg.sequence > rd.min {
+				rd.min = msg.sequence
+			}
+		}
+	}
+	return r.answer()
+}
+
+// Serve the held reads whose state has been applied, or reply with
+// ErrTimeout to those that have waited too long.
+func (r *Replica) answer() error {
+	reads := r.reads[:0]
+	for _, rd := range r.reads {
+		var err error
+		switch {
+		case rd.index == "" && r.sequence >= rd.min:
+			err = r.serve(rd.msg, rd.route)
+		case time.Now().After(rd.deadline):
+			debug("%s %s timed out waiting for state %d at state %d", rd.msg.method, rd.msg.key, rd.min, r.sequence)
+			err = r.sendError(r.requests, rd.route, rd.msg.key, ErrTimeout)
+		default:
+			reads = append(reads, rd)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	r.reads = reads
+	return nil
+}
+
+// Serve a read from the local state.
+func (r *Replica) serve(msg *Message, route [][]byte) error {
+	if msg.method == MethodScan {
+		return r.onScan(msg, route)
+	}
+	return r.onGet(msg, route)
+}
+
+//===========================================================================
+// Leader read confirmation
+//===========================================================================
+
+// confirm is the reply to a read index request held by the leader until a
+// majority of the replicas confirm that it is still the leader.
+type confirm struct {
+	reply   *Message  // the reply with the state of the leader at the request
+	route   [][]byte  // the route of the replica
+	started time.Time // when the request was received
+}
+
+// Handle a read index request from a replica by replying with the state of
+// the leader once it has confirmed that it is still the leader.
+func (l *Leader) onReadIndex(msg *Message, route [][]byte) error {
+	rep := &Message{
+		method:   MethodReadIndex,
+		sequence: l.sequence,
+		term:     l.term,
+		key:      msg.key,
+		body:     nil,
+	}
+
+	l.confirms = append(l.confirms, &confirm{reply: rep, route: route, started: time.Now()})
+	return l.confirm()
+}
+
+// Reply to the read index requests and serve the linearizable reads that
+// arrived before a majority of the replicas last pinged the leader in its
+// term, since no other leader could have been elected by then. If any are
+// still waiting, a heartbeat is sent early so that the replicas ping sooner.
+func (l *Leader) confirm() error {
+	confirmed := l.confirmed()
+	waiting := false
+
+	confirms := l.confirms[:0]
+	for _, c := range l.confirms {
+		switch {
+		case !confirmed.Before(c.started):
+			if err := c.reply.Send(l.snapshots, c.route); err != nil {
+				return err
+			}
+		case time.Since(c.started) > ReadTimeout:
+			// The replica has timed out the read
+		default:
+			confirms = append(confirms, c)
+			waiting = true
+		}
+	}
+	l.confirms = confirms
+
+	for _, rd := range l.reads {
+		if rd.index != confirming {
+			continue
+		}
+		if !confirmed.Before(rd.started) {
+			rd.index = ""
+			continue
+		}
+		waiting = true
+	}
+
+	if waiting && time.Since(l.beat) >= pollInterval {
+		if err := l.heartbeat(); err != nil {
+			return err
+		}
+	}
+	return l.answer()
+}
+
+// Returns the time by which a majority of the replicas that can lead, counting
+// the leader, had last pinged the leader in its current term.
+func (l *Leader) confirmed() time.Time {
+	needed := l.majority() - 1
+	if needed <= 0 {
+		return time.Now()
+	}
+
+	seen := make([]time.Time, 0, len(l.members))
+	for _, peer := range l.network.peers {
+		if peer == l.Replica || peer.partial() {
+			continue
+		}
+		if member, ok := l.members[peer.Name]; ok && member.term == l.term {
+			seen = append(seen, member.Seen)
+		}
+	}
+
+	if len(seen) < needed {
+		return time.Time{}
+	}
+	sort.Slice(seen, func(i, j int) bool { return seen[i].After(seen[j]) })
+	return seen[needed-1]
+}
@@ -0,0 +1,405 @@
+// This file implements an on-disk storage engine that keeps the entries of the
+// store in an append-only data file and only their offsets in memory, so that
+// a replica can hold a store whose values are larger than its memory.
+
+package dolly
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// Name of the data file of the on-disk engine in the data directory.
+const diskStoreFile = "store.dat"
+
+// Written to the data file to mark that the entry of a key was removed from
+// the store, which is not the same as a tombstone (MethodDelete) entry.
+const methodRemove = "Remove"
+
+// The number of replaced entries in the data file of the on-disk engine below
+// which it is not compacted, so that small stores are not rewritten often.
+const diskCompactionMinimum = CompactionInterval
+
+// diskStore appends every entry put in the store to the data file and keeps
+// the offset of the latest entry of each key in memory along with a sorted
+// index of the keys. The file is compacted to its live entries when more of it
+// is replaced entries than live ones, both when it is opened and as entries
+// are put. Snapshots share the offsets and index with the store (copy on
+// write) and read from the same file, which is only ever appended to while it
+// is open. Compaction writes a new file and leaves the previous file open
+// until every snapshot reading it is closed, so the entries a snapshot refers
+// to are never overwritten. Each entry is synced to disk as it is written,
+// except in a staging store, which is synced once it is complete.
+type diskStore struct {
+	path     string           // the path of the data file
+	file     *os.File         // the open data file
+	size     int64            // the offset of the end of the data file
+	garbage  int              // the number of replaced entries in the data file
+	offsets  map[string]int64 // the offset of the entry of each key
+	keys     index            // the keys of the entries in sorted order
+	sequence uint64           // the latest state of the entries put
+	refs     *int32           // the number of open stores and snapshots reading the data file
+	shared   bool             // if the offsets are shared with a snapshot
+	frozen   bool             // if this is a read-only snapshot
+	nosync   bool             // if entries are only synced when the store is synced
+}
+
+// Open the data file at the path, creating it if necessary, and load the
+// offsets of the entries in it.
+func openDiskStore(path string) (*diskStore, error) {
+	s := &diskStore{path: path}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	if err := s.maybeCompact(); err != nil {
+		return nil, err
+	}
+
+	debug("opened %d keys in %s", len(s.offsets), path)
+	return s, nil
+}
+
+// Get implements Store.
+func (s *diskStore) Get(key string) (*Message, bool) {
+	offset, ok := s.offsets[key]
+	if !ok {
+		return nil, false
+	}
+
+	msg, err := s.read(offset)
+	if err != nil {
+		warn("could not read key %q from %s: %s", key, s.path, err)
+		return nil, false
+	}
+	return msg, true
+}
+
+// Put implements Store.
+func (s *diskStore) Put(msg *Message) error {
+	if s.frozen {
+		return errReadOnly
+	}
+
+	offset, err := s.append(msg)
+	if err != nil {
+		return err
+	}
+
+	s.own()
+	if _, ok := s.offsets[msg.key]; ok {
+		s.garbage++
+	} else {
+		s.keys = s.keys.insert(msg.key)
+	}
+	s.offsets[msg.key] = offset
+
+	if msg.sequence > s.sequence {
+		s.sequence = msg.sequence
+	}
+	return s.maybeCompact()
+}
+
+// Delete implements Store.
+func (s *diskStore) Delete(key string) error {
+	if s.frozen {
+		return errReadOnly
+	}
+
+	if _, ok := s.offsets[key]; !ok {
+		return nil
+	}
+
+	marker := &Message{method: methodRemove, key: key}
+	if _, err := s.append(marker); err != nil {
+		return err
+	}
+
+	s.own()
+	delete(s.offsets, key)
+	s.keys = s.keys.remove(key)
+
+	// Both the removed entry and the marker are garbage
+	s.garbage += 2
+	return s.maybeCompact()
+}
+
+// Iterate implements Store.
+func (s *diskStore) Iterate(start string, fn func(*Message) bool) error {
+	for i := s.keys.seek(start); i < len(s.keys); i++ {
+		msg, err := s.read(s.offsets[s.keys[i]])
+		if err != nil {
+			return err
+		}
+
+		if !fn(msg) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Snapshot implements Store.
+func (s *diskStore) Snapshot() Store {
+	s.shared = true
+	atomic.AddInt32(s.refs, 1)
+	return &diskStore{
+		path:     s.path,
+		file:     s.file,
+		size:     s.size,
+		offsets:  s.offsets,
+		keys:     s.keys,
+		sequence: s.sequence,
+		refs:     s.refs,
+		frozen:   true,
+	}
+}
+
+// Sequence implements Store.
+func (s *diskStore) Sequence() uint64 {
+	return s.sequence
+}
+
+// Len implements Store.
+func (s *diskStore) Len() int {
+	return len(s.offsets)
+}
+
+// Bytes implements Store with the size of the data file, which includes the
+// entries that have been replaced since it was last compacted.
+func (s *diskStore) Bytes() int64 {
+	return s.size
+}
+
+// Reset implements Store by replacing the data file with an empty one. The
+// previous file is closed once the snapshots reading from it are closed.
+func (s *diskStore) Reset() error {
+	if s.frozen {
+		return errReadOnly
+	}
+
+	file, err := replaceFile(s.path)
+	if err != nil {
+		return err
+	}
+
+	s.release()
+	s.hold(file)
+	s.size = 0
+	s.garbage = 0
+	s.offsets = make(map[string]int64)
+	s.keys = nil
+	s.sequence = 0
+	s.shared = false
+	return nil
+}
+
+// Sync implements Store by flushing the data file to disk.
+func (s *diskStore) Sync() error {
+	return s.file.Sync()
+}
+
+// Close implements Store by releasing the data file of the store or snapshot.
+func (s *diskStore) Close() error {
+	s.release()
+	return nil
+}
+
+// Append an entry to the end of the data file, returning its offset.
+func (s *diskStore) append(msg *Message) (int64, error) {
+	buf := new(bytes.Buffer)
+	if err := msg.Write(buf); err != nil {
+		return 0, err
+	}
+
+	offset := s.size
+	if _, err := s.file.WriteAt(buf.Bytes(), offset); err != nil {
+		return 0, err
+	}
+	if !s.nosync {
+		if err := s.file.Sync(); err != nil {
+			return 0, err
+		}
+	}
+
+	s.size += int64(buf.Len())
+	return offset, nil
+}
+
+// Read the entry at the offset in the data file.
+func (s *diskStore) read(offset int64) (*Message, error) {
+	return ReadMessage(bufio.NewReader(io.NewSectionReader(s.file, offset, s.size-offset)))
+}
+
+// Hold an open data file, which is closed once the store and every snapshot of
+// it have released it.
+func (s *diskStore) hold(file *os.File) {
+	refs := int32(1)
+	s.file = file
+	s.refs = &refs
+}
+
+// Release the data file, closing it if no other store or snapshot is reading
+// from it. The store cannot be read until it holds a file again.
+func (s *diskStore) release() {
+	if s.file == nil {
+		return
+	}
+
+	if atomic.AddInt32(s.refs, -1) == 0 {
+		s.file.Close()
+	}
+	s.file = nil
+}
+
+// Copy the offsets and index if they are shared with a snapshot.
+func (s *diskStore) own() {
+	if !s.shared {
+		return
+	}
+
+	offsets := make(map[string]int64, len(s.offsets))
+	for key, offset := range s.offsets {
+		offsets[key] = offset
+	}
+
+	keys := make(index, len(s.keys))
+	copy(keys, s.keys)
+
+	s.offsets = offsets
+	s.keys = keys
+	s.shared = false
+}
+
+// Open the data file and read the offset of the latest entry of every key,
+// counting the entries in the file that have been replaced or removed. If the
+// file ends with a partially written entry, it is truncated to the last
+// complete entry.
+func (s *diskStore) load() error {
+	file, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	s.hold(file)
+	s.size = 0
+	s.garbage = 0
+	s.sequence = 0
+	s.shared = false
+	s.offsets = make(map[string]int64)
+	s.keys = nil
+
+	reader := &countingReader{r: bufio.NewReader(s.file)}
+	for {
+		offset := reader.n
+		msg, err := ReadMessage(reader)
+		if err == io.EOF {
+			break
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			warn("truncating partial entry at the end of %s", s.path)
+			if err = s.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+
+		if err != nil {
+			s.release()
+			return err
+		}
+
+		s.size = reader.n
+		if _, ok := s.offsets[msg.key]; ok {
+			s.garbage++
+		}
+
+		if msg.method == methodRemove {
+			delete(s.offsets, msg.key)
+			s.garbage++
+			continue
+		}
+
+		s.offsets[msg.key] = offset
+		if msg.sequence > s.sequence {
+			s.sequence = msg.sequence
+		}
+	}
+
+	s.keys = make(index, 0, len(s.offsets))
+	for key := range s.offsets {
+		s.keys = append(s.keys, key)
+	}
+	s.keys.sort()
+	return nil
+}
+
+// Compact the data file if more of it is replaced entries than live ones.
+func (s *diskStore) maybeCompact() error {
+	if s.garbage < diskCompactionMinimum || s.garbage <= len(s.offsets) {
+		return nil
+	}
+	return s.compact()
+}
+
+// Rewrite the data file with only the live entries of the store, moving it
+// into place so that the file is never partial. The previous file is left open
+// until the snapshots reading from it are closed.
+func (s *diskStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	var werr error
+	w := bufio.NewWriter(f)
+	err = s.Iterate("", func(msg *Message) bool {
+		werr = msg.Write(w)
+		return werr == nil
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	debug("compacted %d keys in %s", len(s.offsets), s.path)
+	s.release()
+	return s.load()
+}
+
+// Create an empty file and move it into place at the path, returning it open.
+// A file that was open at the path remains readable until it is closed.
+func replaceFile(path string) (*os.File, error) {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
@@ -0,0 +1,241 @@
+package dolly
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Open a disk store in a temporary data directory.
+func makeDiskStore(t *testing.T) (*diskStore, func()) {
+	dir, cleanup := makeDataDir(t)
+	s, err := openDiskStore(filepath.Join(dir, diskStoreFile))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return s, func() {
+		s.Close()
+		cleanup()
+	}
+}
+
+// Close the data file of the store and open it again.
+func reopenDiskStore(t *testing.T, s *diskStore) *diskStore {
+	s.Close()
+	reopened, err := openDiskStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reopened
+}
+
+func TestDiskStoreLoad(t *testing.T) {
+	s, cleanup := makeDiskStore(t)
+	defer cleanup()
+
+	putValue(t, s, 1, "b", "1")
+	putValue(t, s, 2, "a", "2")
+	putValue(t, s, 3, "b", "3")
+	putValue(t, s, 4, "c", "4")
+	if err := s.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+
+	s = reopenDiskStore(t, s)
+	if s.Len() != 2 {
+		t.Errorf("expected 2 keys, got %d", s.Len())
+	}
+	if s.Sequence() != 4 {
+		t.Errorf("expected sequence 4, got %d", s.Sequence())
+	}
+	if s.garbage != 3 {
+		t.Errorf("expected 3 replaced entries, got %d", s.garbage)
+	}
+	if _, ok := s.Get("c"); ok {
+		t.Error("removed key was loaded")
+	}
+	checkValue(t, s, "a", "2")
+	checkValue(t, s, "b", "3")
+
+	keys := make([]string, 0)
+	s.Iterate("", func(msg *Message) bool {
+		keys = append(keys, msg.key)
+		return true
+	})
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Errorf("expected keys in order, got %v", keys)
+	}
+}
+
+func TestDiskStoreTruncatedTail(t *testing.T) {
+	s, cleanup := makeDiskStore(t)
+	defer cleanup()
+
+	putValue(t, s, 1, "a", "1")
+	putValue(t, s, 2, "b", "2")
+	complete := s.size
+
+	// Write half of an entry as if the replica crashed while appending it
+	partial := &Message{method: MethodPut, sequence: 3, term: 1, key: "c", body: []byte("3")}
+	if _, err := s.append(partial); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.file.Truncate(complete + (s.size-complete)/2); err != nil {
+		t.Fatal(err)
+	}
+
+	s = reopenDiskStore(t, s)
+	if s.Len() != 2 || s.size != complete {
+		t.Errorf("expected 2 keys in %d bytes, got %d keys in %d bytes", complete, s.Len(), s.size)
+	}
+	if _, ok := s.Get("c"); ok {
+		t.Error("partial entry was loaded")
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != complete {
+		t.Errorf("expected data file to be truncated to %d bytes, got %d", complete, info.Size())
+	}
+
+	// Entries appended after the truncation must be loaded
+	putValue(t, s, 3, "c", "4")
+	s = reopenDiskStore(t, s)
+	checkValue(t, s, "c", "4")
+}
+
+func TestDiskStoreCompaction(t *testing.T) {
+	s, cleanup := makeDiskStore(t)
+	defer cleanup()
+
+	// Overwrite a few keys until the store is compacted while it is open
+	sequence := uint64(0)
+	for i := 0; i <= diskCompactionMinimum; i++ {
+		sequence++
+		putValue(t, s, sequence, fmt.Sprintf("key%d", i%4), fmt.Sprintf("value%d", i))
+	}
+
+	if s.garbage >= diskCompactionMinimum {
+		t.Errorf("expected the store to be compacted, has %d replaced entries", s.garbage)
+	}
+
+	info, err := os.Stat(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != s.size {
+		t.Errorf("expected data file of %d bytes, got %d", s.size, info.Size())
+	}
+
+	if s.Len() != 4 {
+		t.Errorf("expected 4 keys, got %d", s.Len())
+	}
+	for i := diskCompactionMinimum - 3; i <= diskCompactionMinimum; i++ {
+		checkValue(t, s, fmt.Sprintf("key%d", i%4), fmt.Sprintf("value%d", i))
+	}
+
+	s = reopenDiskStore(t, s)
+	if s.Len() != 4 || s.Sequence() != sequence {
+		t.Errorf("expected 4 keys at sequence %d, got %d at %d", sequence, s.Len(), s.Sequence())
+	}
+}
+
+func TestDiskStoreSnapshot(t *testing.T) {
+	s, cleanup := makeDiskStore(t)
+	defer cleanup()
+
+	putValue(t, s, 1, "a", "1")
+	putValue(t, s, 2, "b", "2")
+
+	snap := s.Snapshot()
+	putValue(t, s, 3, "a", "3")
+	putValue(t, s, 4, "c", "4")
+	if err := s.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := snap.Put(&Message{method: MethodPut, key: "d"}); err != errReadOnly {
+		t.Errorf("expected snapshot to be read only, got %v", err)
+	}
+
+	if snap.Len() != 2 || snap.Sequence() != 2 {
+		t.Errorf("expected snapshot of 2 keys at sequence 2, got %d at %d", snap.Len(), snap.Sequence())
+	}
+	checkValue(t, snap, "a", "1")
+	checkValue(t, snap, "b", "2")
+	if _, ok := snap.Get("c"); ok {
+		t.Error("key put after the snapshot is in it")
+	}
+
+	// The snapshot still reads the previous data file after compaction
+	if err := s.compact(); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, snap, "a", "1")
+	checkValue(t, snap, "b", "2")
+	checkValue(t, s, "a", "3")
+	checkValue(t, s, "c", "4")
+	if _, ok := s.Get("b"); ok {
+		t.Error("removed key is in the store")
+	}
+
+	// The previous data file is closed with the last snapshot reading it
+	previous := snap.(*diskStore).file
+	snap.Close()
+	if _, err := previous.Stat(); err == nil {
+		t.Error("expected the previous data file to be closed with its snapshot")
+	}
+
+	// A snapshot still reads the data file after the store is reset
+	snap = s.Snapshot()
+	other := s.Snapshot()
+	if err := s.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	checkValue(t, snap, "a", "3")
+	if s.Len() != 0 {
+		t.Errorf("expected reset store to be empty, has %d keys", s.Len())
+	}
+
+	previous = snap.(*diskStore).file
+	snap.Close()
+	checkValue(t, other, "a", "3")
+	other.Close()
+	if _, err := previous.Stat(); err == nil {
+		t.Error("expected the data file to be closed with the last snapshot")
+	}
+}
+
+func TestDiskStoreStaging(t *testing.T) {
+	s, cleanup := makeDiskStore(t)
+	defer cleanup()
+
+	putValue(t, s, 1, "a", "1")
+	snap := s.Snapshot()
+
+	r := &Replica{Data: filepath.Dir(s.path), Engine: EngineDisk, store: s}
+	stage, err := r.openStaging()
+	if err != nil {
+		t.Fatal(err)
+	}
+	putValue(t, stage, 5, "b", "5")
+
+	if err = r.installStaging(stage); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(r.Data, stagingFile)); !os.IsNotExist(err) {
+		t.Errorf("expected staging file to be moved, got %v", err)
+	}
+
+	checkValue(t, snap, "a", "1")
+	s = reopenDiskStore(t, r.store.(*diskStore))
+	if s.Len() != 1 {
+		t.Errorf("expected 1 key, got %d", s.Len())
+	}
+	checkValue(t, s, "b", "5")
+}
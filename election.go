@@ -0,0 +1,307 @@
+// This file implements leader election using the bully algorithm.
+
+package dolly
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+//===========================================================================
+// Replica election handlers
+//===========================================================================
+
+// Check if the leader has failed or if the current election has timed out,
+// expire the sessions of watchers and the reads waiting for state, and retry
+// the range requests and snapshot chunks that the leader has not sent.
+func (r *Replica) onTick() error {
+	r.observe()
+	r.expireWatchers()
+	if err := r.answer(); err != nil {
+		return err
+	}
+	if err := r.recatch(); err != nil {
+		return err
+	}
+	if err := r.retransfer(); err != nil {
+		return err
+	}
+
+	if r.electing {
+		if time.Now().Before(r.deadline) {
+			return nil
+		}
+
+		// A peer that outranks us answered but never announced itself
+		if r.alive {
+			return r.elect()
+		}
+
+		// A candidate must hear from a majority so that one of them would have
+		// outranked it if it were missing an update acked by a majority
+		if len(r.answered)+1 < r.majority() {
+			warn("only %d of %d replicas answered the election, retrying", len(r.answered)+1, r.majority())
+			return r.elect()
+		}
+
+		// Nobody that outranks us is alive so we are the leader
+		return r.promote()
+	}
+
+	if time.Since(r.heard) > ElectionTimeout {
+		warn("leader %s has not been heard from in %s", r.network.leader.Name, ElectionTimeout)
+		return r.elect()
+	}
+
+	return nil
+}
+
+// Start an election by sending an election message with the state of the
+// replica to every peer that can lead. Peers answer with their own state and
+// term. If a majority answer before the deadline and none of them outrank the
+// replica, it is promoted in a term after every term it has heard of.
+func (r *Replica) elect() error {
+	// Partial replicas cannot lead, so wait for a leader to announce itself
+	if r.partial() {
+		return nil
+	}
+
+	r.electing = true
+	r.alive = false
+	r.answered = make(map[string]bool)
+	r.deadline = time.Now().Add(ElectionTimeout)
+
+	msg := r.mark(&Message{
+		method:   MethodElection,
+		sequence: r.sequence,
+		term:     r.term,
+		key:      r.Name,
+		body:     nil,
+	})
+
+	for _, peer := range r.network.peers {
+		if peer != r && !peer.partial() {
+			if err := r.send(peer, msg); err != nil {
+				return err
+			}
+		}
+	}
+
+	info("started election in term %d at state %d", r.term, r.sequence)
+	return nil
+}
+
+// Returns the number of replicas that can lead that make up a majority.
+func (r *Replica) majority() int {
+	replicas := 0
+	for _, peer := range r.network.peers {
+		if !peer.partial() {
+			replicas++
+		}
+	}
+	return replicas/2 + 1
+}
+
+// Promote the replica to leader in the next term.
+func (r *Replica) promote() error {
+	r.term++
+	r.electing = false
+	r.network.leader = r
+
+	info("promoted to leader in term %d", r.term)
+	if err := r.Disconnect(); err != nil {
+		return err
+	}
+	return errLeaderChanged
+}
+
+// Handle an election message from a candidate by answering with our state and
+// term, then bullying it with our own election if we outrank it. Partial
+// replicas do not take part in elections.
+func (r *Replica) onElection(msg *Message) error {
+	if r.partial() {
+		return nil
+	}
+
+	peer, err := r.network.peers.Get(msg.key)
+	if err != nil {
+		warne(err)
+		return nil
+	}
+
+	if msg.term > r.term {
+		r.term = msg.term
+	}
+
+	rep := r.mark(&Message{
+		method:   MethodAlive,
+		sequence: r.sequence,
+		term:     r.term,
+		key:      r.Name,
+		body:     nil,
+	})
+
+	if err := r.send(peer, rep); err != nil {
+		return err
+	}
+
+	if !r.electing && r.outranks(positionOf(msg), peer) {
+		return r.elect()
+	}
+	return nil
+}
+
+// Handle an alive message from a peer that answered our election, adopting its
+// term if it is later. If the peer outranks us, wait for it to announce itself
+// as the leader.
+func (r *Replica) onAlive(msg *Message) error {
+	if !r.electing {
+		return nil
+	}
+
+	peer, err := r.network.peers.Get(msg.key)
+	if err != nil {
+		warne(err)
+		return nil
+	}
+
+	if msg.term > r.term {
+		r.term = msg.term
+	}
+	r.answered[peer.Name] = true
+
+	if !r.outranks(positionOf(msg), peer) {
+		r.alive = true
+		r.deadline = time.Now().Add(2 * ElectionTimeout)
+	}
+	return nil
+}
+
+// Handle a coordinator message that announces the leader of the term.
+func (r *Replica) onCoordinator(msg *Message) error {
+	leader, err := r.network.peers.Get(msg.key)
+	if err != nil {
+		warne(err)
+		return nil
+	}
+
+	// Fence off stale leaders by letting them know who the leader is
+	if msg.term < r.term {
+		return r.announce(leader, r.network.leader)
+	}
+
+	// Of two leaders in the same term, the lower PID wins
+	if msg.term == r.term && leader.PID > r.network.leader.PID {
+		return nil
+	}
+
+	r.term = msg.term
+	r.electing = false
+	r.heard = time.Now()
+
+	if leader == r.network.leader || leader == r {
+		return nil
+	}
+
+	info("%s is the leader in term %d", leader.Name, r.term)
+	r.network.leader = leader
+	if err := r.Disconnect(); err != nil {
+		return err
+	}
+	return errLeaderChanged
+}
+
+//===========================================================================
+// Replica state positions
+//===========================================================================
+
+// position identifies the latest update applied by a replica by its sequence
+// and the term of the leader that sequenced it. Of two replicas, the one whose
+// latest update was sequenced in a later term has the later state even if its
+// sequence is lower, since the updates of the earlier term past the point the
+// two diverged were never seen by the later leader.
+type position struct {
+	term     uint64 // the term of the leader that sequenced the update
+	sequence uint64 // the sequence of the update
+}
+
+// Returns true if the position is after the other position.
+func (p position) after(o position) bool {
+	return p.term > o.term || (p.term == o.term && p.sequence > o.sequence)
+}
+
+// Returns the position of the latest update applied by the replica.
+func (r *Replica) latest() position {
+	return position{term: r.lastTerm, sequence: r.sequence}
+}
+
+// Returns the position of the sender of a message marked with its state.
+func positionOf(msg *Message) position {
+	term, _ := strconv.ParseUint(msg.options.Get(optLastTerm), 10, 64)
+	return position{term: term, sequence: msg.sequence}
+}
+
+// Mark a message that carries the sequence of the replica with the term of
+// its latest update so that the receiver knows the position of the replica.
+func (r *Replica) mark(msg *Message) *Message {
+	msg.set(optLastTerm, strconv.FormatUint(r.lastTerm, 10))
+	return msg
+}
+
+// Returns true if the replica should lead rather than the peer at the position,
+// since it has the later state or the same state and a lower PID.
+func (r *Replica) outranks(pos position, peer *Replica) bool {
+	own := r.latest()
+	return own.after(pos) || (own == pos && r.PID < peer.PID)
+}
+
+//===========================================================================
+// Peer messaging
+//===========================================================================
+
+// Announce to the peer that the leader is the coordinator of the current term.
+func (r *Replica) announce(peer, leader *Replica) error {
+	msg := r.mark(&Message{
+		method:   MethodCoordinator,
+		sequence: r.sequence,
+		term:     r.term,
+		key:      leader.Name,
+		body:     nil,
+	})
+
+	return r.send(peer, msg)
+}
+
+// Send a message to the requests socket of a peer, connecting to it if this
+// is the first message sent. Messages that cannot be delivered are dropped.
+func (r *Replica) send(peer *Replica, msg *Message) (err error) {
+	if r.conns == nil {
+		r.conns = make(map[string]*zmq.Socket)
+	}
+
+	sock, ok := r.conns[peer.Name]
+	if !ok {
+		if sock, err = r.context.NewSocket(zmq.DEALER); err != nil {
+			return err
+		}
+		if err = sock.SetLinger(0); err != nil {
+			return err
+		}
+		if err = r.connectCurve(sock, peer); err != nil {
+			return err
+		}
+		endpoint := fmt.Sprintf("tcp://%s:%d", peer.Addr, peer.Requests)
+		if err = sock.Connect(endpoint); err != nil {
+			return err
+		}
+		r.conns[peer.Name] = sock
+	}
+
+	if err = msg.Send(sock, nil); err != nil {
+		debug("could not send %s to %s: %s", msg.method, peer.Name, err)
+	}
+	return nil
+}
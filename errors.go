@@ -0,0 +1,89 @@
+package dolly
+
+import (
+	"errors"
+	"fmt"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Errors returned to clients, which are sent as the body of MethodError
+// replies and decoded back into these values by the client.
+var (
+	ErrNotFound  = errors.New("key not found")
+	ErrNotLeader = errors.New("not the leader")
+	ErrTimeout   = errors.New("request timed out")
+	ErrConflict  = errors.New("version conflict")
+	ErrTooLarge  = errors.New("key or value too large")
+
+	ErrLeaseNotFound = errors.New("lease not found")
+	ErrNotReplicated = errors.New("key not replicated")
+
+	ErrUnacknowledged = errors.New("write not acknowledged by enough replicas")
+)
+
+// Errors that can be decoded from the body of a MethodError reply.
+var replyErrors = []error{ErrNotFound, ErrNotLeader, ErrTimeout, ErrConflict, ErrTooLarge, ErrLeaseNotFound, ErrNotReplicated, ErrUnacknowledged}
+
+// ProtocolError is returned by RecvMessage when a malformed message is read.
+type ProtocolError struct {
+	Reason string // why the message was rejected
+}
+
+// Error implements the error interface.
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("protocol error: %s", e.Reason)
+}
+
+// Malformed messages from the leader cannot be replied to, so protocol errors
+// are logged and the message dropped; other errors are returned.
+func dropProtocolError(err error) error {
+	if perr, ok := err.(*ProtocolError); ok {
+		warne(perr)
+		return nil
+	}
+	return err
+}
+
+// Create a protocol error with the reason formatted as in fmt.Sprintf.
+func protocolErrorf(reason string, a ...interface{}) *ProtocolError {
+	return &ProtocolError{Reason: fmt.Sprintf(reason, a...)}
+}
+
+// Decode the error sent in a MethodError reply.
+func decodeError(rep *Message) error {
+	body := string(rep.body)
+	for _, err := range replyErrors {
+		if body == err.Error() {
+			return err
+		}
+	}
+	return errors.New(body)
+}
+
+// Send an error reply with the current state of the replica on the socket.
+// Unless an election is under way, the reply names the leader known to the
+// replica so that clients can send their writes to it.
+func (r *Replica) sendError(sock *zmq.Socket, route [][]byte, key string, err error) error {
+	rep := &Message{
+		method:   MethodError,
+		sequence: r.sequence,
+		term:     r.term,
+		key:      key,
+		body:     []byte(err.Error()),
+	}
+	if !r.electing && r.network != nil && r.network.leader != nil {
+		rep.set(optLeader, r.network.leader.Name)
+	}
+
+	if sock == r.requests {
+		r.metrics.end(rep, route)
+	}
+	return rep.Send(sock, route)
+}
+
+// Send a reply to a client request on the requests socket.
+func (r *Replica) respond(rep *Message, route [][]byte) error {
+	r.metrics.end(rep, route)
+	return rep.Send(r.requests, route)
+}
@@ -1,6 +1,7 @@
 package dolly
 
 import (
+	"encoding/binary"
 	"fmt"
 	"time"
 
@@ -10,7 +11,17 @@ import (
 // Leader defines a server that can respond to both Get and Put requests and
 // publishes state to all replica subscribers.
 type Leader struct {
-	Replica
+	*Replica
+	beat        time.Time            // last time a heartbeat was published
+	members     map[string]*Member   // the liveness of each replica that has pinged
+	leases      map[LeaseID]*lease   // the leases that keys can be attached to
+	snapshotter *snapshotter         // streams snapshots from frozen views of the store
+	transfers   map[string]time.Time // when each transfer handed to the snapshotter expires
+	relay       *zmq.Socket          // socket the snapshotter sends chunks on
+	held        []*held              // replies to writes waiting for acks
+	confirms    []*confirm           // replies to read indexes waiting for leadership to be confirmed
+	reported    time.Time            // last time the membership was logged
+	collected   uint64               // tombstones up to this state have been collected
 }
 
 // Serve the leader, publishing state updates and responding to snapshot
@@ -20,7 +31,24 @@ func (l *Leader) Serve(ctx *zmq.Context, echan chan<- error) {
 
 	// Initialize the store and save state
 	l.context = ctx
-	l.store = make(map[string]*Message)
+	if l.store == nil {
+		if l.store, err = l.openStore(); err != nil {
+			echan <- err
+			return
+		}
+	}
+	l.members = make(map[string]*Member)
+	l.transfers = make(map[string]time.Time)
+	l.metrics.abandon()
+
+	// Recover the store and resume the sequence if this is the first time serving
+	if err = l.Recover(); err != nil {
+		echan <- err
+		return
+	}
+
+	// Restart the clocks of the leases of the keys in the store
+	l.recoverLeases()
 
 	// Connect all of the sockets
 	if err = l.Bind(); err != nil {
@@ -28,15 +56,34 @@ func (l *Leader) Serve(ctx *zmq.Context, echan chan<- error) {
 		return
 	}
 
+	// Announce leadership to all peers, fencing off any stale leaders
+	if err = l.announceAll(); err != nil {
+		echan <- err
+		return
+	}
+
+	// Stream snapshots to replicas without blocking requests
+	if err = l.startSnapshotter(); err != nil {
+		echan <- err
+		return
+	}
+
 	// Create a poller to collect info from the sockets
 	poller := zmq.NewPoller()
 	poller.Add(l.snapshots, zmq.POLLIN)
 	poller.Add(l.requests, zmq.POLLIN)
+	poller.Add(l.relay, zmq.POLLIN)
 
-	// Run the replica server forever
+	// Run the leader server until it steps down
 	for {
-		// Poll the sockets with a 1 second timeout
-		items, err := poller.Poll(time.Second * 1)
+		// Poll the sockets with a heartbeat interval timeout, or more often
+		// if replies or reads are held so that they time out promptly
+		timeout := HeartbeatInterval
+		if len(l.held) > 0 || len(l.reads) > 0 || len(l.confirms) > 0 {
+			timeout = pollInterval
+		}
+
+		items, err := poller.Poll(timeout)
 		if err != nil {
 			echan <- err
 			return
@@ -61,6 +108,20 @@ func (l *Leader) Serve(ctx *zmq.Context, echan chan<- error) {
 				}
 			}
 
+			// Relay snapshot chunks
+			if item.Socket == l.relay {
+				if err := l.onRelay(); err != nil {
+					echan <- err
+					return
+				}
+			}
+
+		}
+
+		// Publish heartbeats to the replicas and check their liveness
+		if err := l.onTick(); err != nil {
+			echan <- err
+			return
 		}
 	}
 }
@@ -72,6 +133,9 @@ func (l *Leader) Bind() (err error) {
 	if l.snapshots, err = l.context.NewSocket(zmq.ROUTER); err != nil {
 		return err
 	}
+	if err = l.serveCurve(l.snapshots); err != nil {
+		return err
+	}
 	endpoint := fmt.Sprintf("tcp://*:%d", l.Snapshots)
 	if err = l.snapshots.Bind(endpoint); err != nil {
 		return err
@@ -82,91 +146,490 @@ func (l *Leader) Bind() (err error) {
 	if l.updates, err = l.context.NewSocket(zmq.PUB); err != nil {
 		return err
 	}
+	if err = l.serveCurve(l.updates); err != nil {
+		return err
+	}
 	endpoint = fmt.Sprintf("tcp://*:%d", l.Updates)
 	if err = l.updates.Bind(endpoint); err != nil {
 		return err
 	}
 	info("bound updates PUB socket to %s", endpoint)
 
-	// Create the requests socket
-	if l.requests, err = l.context.NewSocket(zmq.ROUTER); err != nil {
-		return err
-	}
-	endpoint = fmt.Sprintf("tcp://*:%d", l.Requests)
-	if err = l.requests.Bind(endpoint); err != nil {
-		return err
-	}
-	info("bound requests ROUTER socket to %s", endpoint)
-
-	return nil
+	// Bind the requests socket if not already bound as a replica
+	return l.Replica.Bind()
 }
 
 // Handle a request from a client.
 func (l *Leader) onRequests() error {
 	// Get the message from the socket
-	msg, route, err := RecvMessage(l.requests, true)
+	msg, route, user, err := l.recvRequest(l.requests)
 	if err != nil {
+		if perr, ok := err.(*ProtocolError); ok {
+			warne(perr)
+			return l.sendError(l.requests, route, "", perr)
+		}
 		return err
 	}
+	l.metrics.begin(msg, route)
+
+	// Reject bad requests before the write is applied
+	if err := l.validate(msg); err != nil {
+		return l.sendError(l.requests, route, msg.key, err)
+	}
 
 	// Mux the request correctly
 	switch msg.method {
-	case MethodGet:
-		return l.onGet(msg, route)
+	case MethodGet, MethodScan:
+		return l.onRead(msg, route)
+	case MethodWatch:
+		return l.onWatch(msg, route)
+	case MethodUnwatch:
+		return l.onUnwatch(msg, route)
+	case MethodStatus:
+		return l.onStatus(msg, route)
 	case MethodPut:
 		return l.onPut(msg, route)
+	case MethodDelete:
+		return l.onDelete(msg, route)
+	case MethodCAS:
+		return l.onCAS(msg, route)
+	case MethodTxn:
+		return l.onTxn(msg, route)
+	case MethodGrant:
+		return l.onGrant(msg, route)
+	case MethodKeepAlive:
+		return l.onKeepAlive(msg, route)
+	case MethodRevoke:
+		return l.onRevoke(msg, route)
+	case MethodElection, MethodAlive, MethodCoordinator:
+		return l.onControl(msg, user)
+	default:
+		return l.sendError(l.requests, route, msg.key, protocolErrorf("unknown request method %s", msg.method))
+	}
+}
+
+// Handle an election message from a peer, dropping it if it was not sent with
+// the key of the peer. The leader ignores Alive, since it is not electing.
+func (l *Leader) onControl(msg *Message, user string) error {
+	if !l.fromPeer(msg, user) {
+		return nil
+	}
+
+	switch msg.method {
+	case MethodElection:
+		return l.onElection(msg)
+	case MethodCoordinator:
+		return l.onCoordinator(msg)
 	default:
-		return fmt.Errorf("unknown request method %s", msg.method)
+		return nil
+	}
+}
+
+// Reject requests with an unknown write concern or with parts too large to be
+// read back from the write-ahead log and the store once they are persisted.
+func (l *Leader) validate(msg *Message) error {
+	if _, err := l.quorum(WriteConcern(msg.options.Get(optConcern))); err != nil {
+		return err
 	}
+	return msg.checkSize()
 }
 
-// Handle snapshots to bring a replica up to date.
+// Handle snapshots and ranges to bring a replica up to date.
 func (l *Leader) onSnapshots() error {
 	// Read the message off the wire
 	msg, route, err := RecvMessage(l.snapshots, true)
 	if err != nil {
+		if perr, ok := err.(*ProtocolError); ok {
+			warne(perr)
+			return l.sendError(l.snapshots, route, "", perr)
+		}
 		return err
 	}
 
-	// Ensure the message type is correct
-	if msg.method != MethodSnapshot {
-		return fmt.Errorf("bad request, cannot recv %s on snapshots", msg.method)
+	// Mux the request correctly
+	switch msg.method {
+	case MethodSnapshot:
+		return l.onSnapshot(msg, route)
+	case MethodRange:
+		return l.onRange(msg, route)
+	case MethodPing:
+		return l.onPing(msg)
+	case MethodAck:
+		return l.onAck(msg)
+	case MethodReadIndex:
+		return l.onReadIndex(msg, route)
+	default:
+		return l.sendError(l.snapshots, route, msg.key, protocolErrorf("cannot recv %s on snapshots", msg.method))
+	}
+}
+
+// Send the updates from the log after the requested sequence and before the
+// sequence in the body of the request to a replica that has missed them,
+// filtered by the subtrees of a partial replica. At most RangeSize updates are
+// sent, and the body of the reply holds the last state they cover and its term
+// so that the replica can request the rest of the range.
+func (l *Leader) onRange(msg *Message, route [][]byte) error {
+	if len(msg.body) != 8 {
+		return l.sendError(l.snapshots, route, "", protocolErrorf("range requires an end sequence"))
+	}
+	end := binary.LittleEndian.Uint64(msg.body)
+	if end <= msg.sequence {
+		return l.sendError(l.snapshots, route, "", protocolErrorf("range must end after state %d", msg.sequence))
+	}
+
+	// Never send a replica with later state the updates of a stale leader
+	if positionOf(msg).after(l.latest()) {
+		return l.sendError(l.snapshots, route, "", errLeaderBehind)
+	}
+
+	// Ensure the log still holds every update the replica is missing
+	if !l.logged(msg.sequence) {
+		return l.sendError(l.snapshots, route, "", fmt.Errorf("sequence %d is no longer in the log", msg.sequence+1))
+	}
+
+	// Ensure the replica has not applied updates of another leader that are
+	// not in the log, so that it fetches a full snapshot instead
+	if !l.follows(positionOf(msg)) {
+		return l.sendError(l.snapshots, route, "", fmt.Errorf("state %d diverged from the log", msg.sequence))
+	}
+
+	// Send the updates in the range, up to the range size
+	covered := l.sequence
+	if end <= covered {
+		covered = end - 1
+	}
+
+	updates := 0
+	subtrees := msg.options[optSubtree]
+	for _, entry := range l.log {
+		if entry.sequence <= msg.sequence || entry.sequence >= end || !matches(entry, subtrees) {
+			continue
+		}
+
+		if err := entry.Send(l.snapshots, route); err != nil {
+			debug("could not send range to replica: %s", err)
+			return nil
+		}
+
+		updates++
+		if updates == RangeSize {
+			covered = entry.sequence
+			break
+		}
 	}
 
-	// Send every entry in the store to the client
-	keys := 0
-	for _, val := range l.store {
-		keys++
-		val.Send(l.snapshots, route)
+	// Send finished with sequence number and the last state covered along
+	// with the term of its update
+	term, ok := l.termAt(covered)
+	if !ok {
+		term = positionOf(msg).term
 	}
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint64(body[:8], covered)
+	binary.LittleEndian.PutUint64(body[8:], term)
 
-	// Send finished with sequence number
-	reply := &Message{
+	reply := l.mark(&Message{
 		method:   MethodTerm,
 		sequence: l.sequence,
+		term:     l.term,
 		key:      "",
-		body:     nil,
+		body:     body,
+	})
+	if err := reply.Send(l.snapshots, route); err != nil {
+		debug("could not send range to replica: %s", err)
+		return nil
 	}
-	reply.Send(l.snapshots, route)
-	info("sent %d keys on state snapshot %d", keys, l.sequence)
+	info("sent %d updates after state %d", updates, msg.sequence)
 	return nil
 }
 
 // Handle a Put request from a client
-func (l *Leader) onPut(msg *Message, route []byte) error {
-	// Store the message and increment the state sequence
+func (l *Leader) onPut(msg *Message, route [][]byte) error {
+	if err := l.prepareLease(msg); err != nil {
+		return l.sendError(l.requests, route, msg.key, err)
+	}
+
+	if err := l.publish(msg); err != nil {
+		return err
+	}
+
+	// Respond to the client
+	return l.reply(msg, route)
+}
+
+// Handle a Delete request from a client, which is published like a Put and
+// stored as a tombstone so that snapshots and late replicas converge.
+func (l *Leader) onDelete(msg *Message, route [][]byte) error {
+	if l.version(msg.key) == 0 {
+		return l.sendError(l.requests, route, msg.key, ErrNotFound)
+	}
+
+	msg.body = nil
+	if err := l.publish(msg); err != nil {
+		return err
+	}
+
+	// Respond to the client
+	return l.reply(msg, route)
+}
+
+// Handle a CompareAndSwap request from a client, which is published as a Put
+// only if the version of the key matches the sequence of the request. A
+// sequence of zero requires that the key does not exist.
+func (l *Leader) onCAS(msg *Message, route [][]byte) error {
+	if version := l.version(msg.key); version != msg.sequence {
+		rep := &Message{
+			method:   MethodError,
+			sequence: version,
+			term:     l.term,
+			key:      msg.key,
+			body:     []byte(ErrConflict.Error()),
+		}
+		return l.respond(rep, route)
+	}
+
+	msg.method = MethodPut
+	if err := l.prepareLease(msg); err != nil {
+		return l.sendError(l.requests, route, msg.key, err)
+	}
+
+	if err := l.publish(msg); err != nil {
+		return err
+	}
+
+	// Respond to the client
+	return l.reply(msg, route)
+}
+
+// Returns the state the key was last written in, or zero if it does not exist.
+func (l *Leader) version(key string) uint64 {
+	if val, ok := l.store.Get(key); ok && val.method != MethodDelete {
+		return val.sequence
+	}
+	return 0
+}
+
+// Reply to a write with the state it was sequenced in and the name of the
+// leader so that clients can learn which replica is the leader. If the write
+// concern of the request requires acks from replicas, the reply is held until
+// they arrive.
+func (l *Leader) reply(msg *Message, route [][]byte) error {
+	rep := &Message{
+		method:   msg.method,
+		sequence: msg.sequence,
+		term:     msg.term,
+		key:      msg.key,
+		body:     []byte(l.Name),
+		options:  msg.options,
+	}
+
+	acks, _ := l.quorum(WriteConcern(msg.options.Get(optConcern)))
+	if l.acked(msg.sequence) < acks {
+		l.held = append(l.held, &held{reply: rep, route: route, acks: acks, deadline: time.Now().Add(AckTimeout)})
+		return nil
+	}
+	return l.respond(rep, route)
+}
+
+// Sequence an update, persist it, and publish it to all replicas.
+func (l *Leader) publish(msg *Message) error {
+	// Sequence the update and write it ahead to disk before it is published
+	if err := l.sequenceUpdate(msg); err != nil {
+		return err
+	}
+
+	// Publish the message to all replicas subscribed to its topic
+	if err := msg.Send(l.updates, msg.topic()); err != nil {
+		return err
+	}
+
+	// Store the state locally and append it to the log
+	if err := l.applyUpdate(msg); err != nil {
+		return err
+	}
+
+	info("published state %d %s", l.sequence, msg)
+	return l.answer()
+}
+
+// Assign the next state of the leader to an update and write it to the
+// write-ahead log.
+func (l *Leader) sequenceUpdate(msg *Message) error {
 	l.sequence++
+	l.lastTerm = l.term
 	msg.sequence = l.sequence
+	msg.term = l.term
+	return l.writeAhead(msg)
+}
 
-	// Publish the message to all replicas
-	if err := msg.Send(l.updates, nil); err != nil {
+// Apply a sequenced update to the store and the log, then compact the
+// write-ahead log, which must only happen once the store holds the update.
+func (l *Leader) applyUpdate(msg *Message) error {
+	if err := l.attach(msg); err != nil {
+		return err
+	}
+	if err := l.update(msg); err != nil {
 		return err
 	}
+	l.record(msg)
+	return l.checkpoint()
+}
 
-	// Store the state locally
-	l.store[msg.key] = msg
-	info("published state %d updated %s=%s", l.sequence, msg.key, msg.body)
+// Garbage collect the tombstones that every replica has acknowledged.
+func (l *Leader) collect() {
+	watermark := l.sequence
+	for _, peer := range l.network.peers {
+		if peer == l.Replica {
+			continue
+		}
 
-	// Respond to the client
-	return msg.Send(l.requests, route)
+		member, ok := l.members[peer.Name]
+		if !ok {
+			return
+		}
+
+		if member.Sequence < watermark {
+			watermark = member.Sequence
+		}
+	}
+
+	if watermark > l.collected {
+		l.collected = watermark
+		l.purge(watermark)
+	}
+}
+
+// Expire leases, watchers, held replies and reads, then publish a heartbeat
+// with the current sequence and the state up to which tombstones have been
+// collected if the interval has passed.
+func (l *Leader) onTick() error {
+	// Delete the keys of expired leases
+	if err := l.expireLeases(); err != nil {
+		return err
+	}
+	l.expireWatchers()
+
+	// Time out the replies waiting for acks and the reads waiting for state
+	// or for the leadership to be confirmed
+	if err := l.settle(); err != nil {
+		return err
+	}
+	if err := l.confirm(); err != nil {
+		return err
+	}
+
+	if time.Since(l.beat) < HeartbeatInterval {
+		return nil
+	}
+
+	// Check which replicas are still pinging and update the metrics
+	l.checkMembers()
+	l.observe()
+
+	// Collect tombstones and let the replicas know which they can collect
+	l.collect()
+	return l.heartbeat()
+}
+
+// Publish a heartbeat with the state of the leader and the tombstones that
+// the replicas can collect.
+func (l *Leader) heartbeat() error {
+	collected := make([]byte, 8)
+	binary.LittleEndian.PutUint64(collected, l.collected)
+
+	l.beat = time.Now()
+	beat := &Message{
+		method:   MethodHeartbeat,
+		sequence: l.sequence,
+		term:     l.term,
+		key:      l.Name,
+		body:     collected,
+	}
+	return beat.Send(l.updates, beat.topic())
+}
+
+// Handle an election from a replica that has lost the leader by letting it
+// know that the leader is still alive, in a term after the candidate's. If the
+// candidate has later state, the leader steps down so that it can lead instead.
+func (l *Leader) onElection(msg *Message) error {
+	peer, err := l.network.peers.Get(msg.key)
+	if err != nil {
+		warne(err)
+		return nil
+	}
+
+	if positionOf(msg).after(l.latest()) {
+		if msg.term > l.term {
+			l.term = msg.term
+		}
+		rep := l.mark(&Message{
+			method:   MethodAlive,
+			sequence: l.sequence,
+			term:     l.term,
+			key:      l.Name,
+			body:     nil,
+		})
+		if err := l.send(peer, rep); err != nil {
+			return err
+		}
+		return l.stepDown(peer)
+	}
+
+	if msg.term >= l.term {
+		l.term = msg.term + 1
+		return l.announceAll()
+	}
+	return l.announce(peer, l.Replica)
+}
+
+// Handle a coordinator message from another leader. The leader with the later
+// state wins, then the leader of the later term, then the lower PID. If this
+// leader wins, it announces itself in a term after the other leader's.
+func (l *Leader) onCoordinator(msg *Message) error {
+	leader, err := l.network.peers.Get(msg.key)
+	if err != nil {
+		warne(err)
+		return nil
+	}
+
+	if leader == l.Replica {
+		return nil
+	}
+
+	other, own := positionOf(msg), l.latest()
+	if other.after(own) || (other == own && (msg.term > l.term || (msg.term == l.term && leader.PID < l.PID))) {
+		if msg.term > l.term {
+			l.term = msg.term
+		}
+		return l.stepDown(leader)
+	}
+
+	// Fence off the other leader in a later term
+	if msg.term >= l.term {
+		l.term = msg.term + 1
+		return l.announceAll()
+	}
+	return l.announce(leader, l.Replica)
+}
+
+// Step down to follow the peer, which has been or is being elected leader.
+func (l *Leader) stepDown(leader *Replica) error {
+	info("stepping down, %s is the leader in term %d", leader.Name, l.term)
+	l.network.leader = leader
+	if err := l.Disconnect(); err != nil {
+		return err
+	}
+	return errLeaderChanged
+}
+
+// Announce leadership to all peers, fencing off any stale leaders.
+func (l *Leader) announceAll() error {
+	for _, peer := range l.network.peers {
+		if peer != l.Replica {
+			if err := l.announce(peer, l.Replica); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
@@ -0,0 +1,284 @@
+// This file implements key expiration with leases that are owned by the
+// leader. Keys are attached to a lease when they are put and are deleted when
+// the lease expires or is revoked, as a sequenced transaction so that every
+// replica deletes them in the same state.
+
+package dolly
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// LeaseID identifies a lease granted by the leader.
+type LeaseID uint64
+
+// lease is a time to live that keys can be attached to.
+type lease struct {
+	id      LeaseID
+	ttl     time.Duration
+	expires time.Time
+	keys    map[string]struct{}
+}
+
+// Returns the lease that the message is attached to, or zero if none.
+func leaseOf(msg *Message) LeaseID {
+	if msg == nil || msg.method != MethodPut {
+		return 0
+	}
+
+	id, _ := strconv.ParseUint(msg.options.Get(optLease), 10, 64)
+	return LeaseID(id)
+}
+
+//===========================================================================
+// Leader lease management
+//===========================================================================
+
+// Rebuild the leases from the keys in the store when the leader is elected,
+// restarting the clock on each of them since the old leader's clock is lost.
+// Leases that have no keys attached are not recovered.
+func (l *Leader) recoverLeases() {
+	l.leases = make(map[LeaseID]*lease)
+	err := l.store.Iterate("", func(val *Message) bool {
+		id := leaseOf(val)
+		if id == 0 {
+			return true
+		}
+
+		lse, ok := l.leases[id]
+		if !ok {
+			ttl, _ := time.ParseDuration(val.options.Get(optTTL))
+			lse = &lease{id: id, ttl: ttl, expires: time.Now().Add(ttl), keys: make(map[string]struct{})}
+			l.leases[id] = lse
+		}
+		lse.keys[val.key] = struct{}{}
+		return true
+	})
+	if err != nil {
+		warne(err)
+	}
+
+	if len(l.leases) > 0 {
+		info("recovered %d leases from the store", len(l.leases))
+	}
+}
+
+// Create a new lease with the specified ttl.
+func (l *Leader) grant(ttl time.Duration) *lease {
+	lse := &lease{
+		id:      LeaseID(rand.Int63()),
+		ttl:     ttl,
+		expires: time.Now().Add(ttl),
+		keys:    make(map[string]struct{}),
+	}
+
+	l.leases[lse.id] = lse
+	debug("granted lease %d for %s", lse.id, ttl)
+	return lse
+}
+
+// Prepare a Put for publishing by granting it a lease if it has a ttl or
+// validating the lease it is attached to, recording the lease and its ttl in
+// the options of the message so that the replicas know about it.
+func (l *Leader) prepareLease(msg *Message) error {
+	if ttl := msg.options.Get(optTTL); ttl != "" && msg.options.Get(optLease) == "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return protocolErrorf("bad ttl %q", ttl)
+		}
+
+		msg.set(optLease, strconv.FormatUint(uint64(l.grant(d).id), 10))
+		return nil
+	}
+
+	if msg.options.Get(optLease) == "" {
+		return nil
+	}
+
+	lse, ok := l.leases[leaseOf(msg)]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+
+	msg.set(optTTL, lse.ttl.String())
+	return nil
+}
+
+// Attach the keys written by the update to the lease of the update, detaching
+// them from any lease they were previously attached to. Must be called before
+// the store is updated.
+func (l *Leader) attach(msg *Message) error {
+	if msg.method != MethodTxn {
+		l.reattach(msg.key, leaseOf(msg))
+		return nil
+	}
+
+	ops, err := decodeOps(msg.body)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		if op.method != MethodCheck {
+			l.reattach(op.key, 0)
+		}
+	}
+	return nil
+}
+
+// Move the key from its current lease to the specified lease (or none).
+func (l *Leader) reattach(key string, id LeaseID) {
+	val, _ := l.store.Get(key)
+	if old, ok := l.leases[leaseOf(val)]; ok {
+		delete(old.keys, key)
+	}
+
+	if lse, ok := l.leases[id]; ok {
+		lse.keys[key] = struct{}{}
+	}
+}
+
+// Expire the leases whose ttl has passed.
+func (l *Leader) expireLeases() error {
+	now := time.Now()
+	for _, lse := range l.leases {
+		if now.After(lse.expires) {
+			info("lease %d expired", lse.id)
+			if err := l.revoke(lse); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Revoke the lease, publishing a transaction that deletes all of its keys.
+func (l *Leader) revoke(lse *lease) error {
+	delete(l.leases, lse.id)
+	if len(lse.keys) == 0 {
+		return nil
+	}
+
+	txn := new(Txn)
+	for key := range lse.keys {
+		txn.Delete(key)
+	}
+
+	msg, err := txn.message()
+	if err != nil {
+		return err
+	}
+
+	debug("deleting %d keys attached to lease %d", len(lse.keys), lse.id)
+	return l.publish(msg)
+}
+
+//===========================================================================
+// Leader lease request handlers
+//===========================================================================
+
+// Handle a Grant request from a client for a lease with the ttl in the options.
+func (l *Leader) onGrant(msg *Message, route [][]byte) error {
+	ttl, err := time.ParseDuration(msg.options.Get(optTTL))
+	if err != nil || ttl <= 0 {
+		return l.sendError(l.requests, route, "", protocolErrorf("bad ttl %q", msg.options.Get(optTTL)))
+	}
+
+	lse := l.grant(ttl)
+	msg.sequence = l.sequence
+	msg.term = l.term
+	msg.set(optLease, strconv.FormatUint(uint64(lse.id), 10))
+	return l.reply(msg, route)
+}
+
+// Handle a KeepAlive request from a client, restarting the clock on the lease.
+func (l *Leader) onKeepAlive(msg *Message, route [][]byte) error {
+	id, _ := strconv.ParseUint(msg.options.Get(optLease), 10, 64)
+	lse, ok := l.leases[LeaseID(id)]
+	if !ok {
+		return l.sendError(l.requests, route, "", ErrLeaseNotFound)
+	}
+
+	lse.expires = time.Now().Add(lse.ttl)
+	msg.sequence = l.sequence
+	msg.term = l.term
+	return l.reply(msg, route)
+}
+
+// Handle a Revoke request from a client, deleting the keys of the lease.
+func (l *Leader) onRevoke(msg *Message, route [][]byte) error {
+	id, _ := strconv.ParseUint(msg.options.Get(optLease), 10, 64)
+	lse, ok := l.leases[LeaseID(id)]
+	if !ok {
+		return l.sendError(l.requests, route, "", ErrLeaseNotFound)
+	}
+
+	if err := l.revoke(lse); err != nil {
+		return err
+	}
+
+	msg.sequence = l.sequence
+	msg.term = l.term
+	return l.reply(msg, route)
+}
+
+//===========================================================================
+// Client lease requests
+//===========================================================================
+
+// Grant a lease with the specified ttl that keys can be attached to with the
+// WithLease option. The lease must be kept alive or its keys are deleted.
+func (c *Client) Grant(ctx context.Context, ttl time.Duration) (LeaseID, error) {
+	msg := &Message{method: MethodGrant}
+	rep, err := c.request(ctx, msg.apply([]Option{WithTTL(ttl)}))
+	if err != nil {
+		return 0, err
+	}
+
+	id, _ := strconv.ParseUint(rep.options.Get(optLease), 10, 64)
+	return LeaseID(id), nil
+}
+
+// KeepAlive restarts the clock on the lease. Returns ErrLeaseNotFound if the
+// lease has already expired.
+func (c *Client) KeepAlive(ctx context.Context, id LeaseID) error {
+	msg := &Message{method: MethodKeepAlive}
+	_, err := c.request(ctx, msg.apply([]Option{WithLease(id)}))
+	return err
+}
+
+// Revoke the lease, deleting every key that is attached to it.
+func (c *Client) Revoke(ctx context.Context, id LeaseID) error {
+	msg := &Message{method: MethodRevoke}
+	_, err := c.request(ctx, msg.apply([]Option{WithLease(id)}))
+	return err
+}
+
+// Grant a lease on the leader. See Client.Grant for details.
+func (c *Cluster) Grant(ctx context.Context, ttl time.Duration) (LeaseID, error) {
+	msg := &Message{method: MethodGrant}
+	rep, err := c.leaderRequest(ctx, msg.apply([]Option{WithTTL(ttl)}))
+	if err != nil {
+		return 0, err
+	}
+
+	id, _ := strconv.ParseUint(rep.options.Get(optLease), 10, 64)
+	return LeaseID(id), nil
+}
+
+// KeepAlive restarts the clock on the lease on the leader.
+func (c *Cluster) KeepAlive(ctx context.Context, id LeaseID) error {
+	msg := &Message{method: MethodKeepAlive}
+	_, err := c.write(ctx, msg.apply([]Option{WithLease(id)}))
+	return err
+}
+
+// Revoke the lease on the leader, deleting every key that is attached to it.
+func (c *Cluster) Revoke(ctx context.Context, id LeaseID) error {
+	msg := &Message{method: MethodRevoke}
+	_, err := c.write(ctx, msg.apply([]Option{WithLease(id)}))
+	return err
+}
@@ -0,0 +1,122 @@
+// This file handles liveness tracking of the replicas by the leader.
+
+package dolly
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Member describes the liveness of a replica as seen by the leader.
+type Member struct {
+	Name     string    // the name of the replica
+	Alive    bool      // if the replica has pinged within the election timeout
+	Seen     time.Time // last time a ping was received from the replica
+	Sequence uint64    // the latest state applied by the replica
+	Lag      uint64    // the number of states the replica is behind the leader
+	term     uint64    // the term of the leader the replica last pinged in
+}
+
+// Membership is a table of the replicas that the leader is tracking.
+type Membership []Member
+
+// String returns a table of the members for logging.
+func (m Membership) String() string {
+	buf := new(bytes.Buffer)
+	w := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "replica\talive\tlast seen\tstate\tlag")
+	for _, member := range m {
+		seen := "never"
+		if !member.Seen.IsZero() {
+			seen = time.Since(member.Seen).Round(time.Millisecond).String() + " ago"
+		}
+		fmt.Fprintf(w, "%s\t%t\t%s\t%d\t%d\n", member.Name, member.Alive, seen, member.Sequence, member.Lag)
+	}
+	w.Flush()
+	return buf.String()
+}
+
+// Membership returns the liveness and lag of every replica ordered by name.
+func (l *Leader) Membership() Membership {
+	members := make(Membership, 0, len(l.network.peers))
+	for _, peer := range l.network.peers {
+		if peer == l.Replica {
+			continue
+		}
+
+		member := Member{Name: peer.Name}
+		if m, ok := l.members[peer.Name]; ok {
+			member = *m
+		}
+
+		member.Alive = !member.Seen.IsZero() && time.Since(member.Seen) < ElectionTimeout
+		if member.Sequence < l.sequence {
+			member.Lag = l.sequence - member.Sequence
+		}
+		members = append(members, member)
+	}
+
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members
+}
+
+// Handle a ping from a replica with the latest state it has applied.
+func (l *Leader) onPing(msg *Message) error {
+	member, ok := l.members[msg.key]
+	if !ok {
+		member = &Member{Name: msg.key}
+		l.members[msg.key] = member
+	}
+
+	if !member.Alive {
+		info("replica %s is alive at state %d", msg.key, msg.sequence)
+		member.Alive = true
+	}
+
+	member.Seen = time.Now()
+	member.term = msg.term
+	if msg.sequence > member.Sequence {
+		member.Sequence = msg.sequence
+	}
+	return nil
+}
+
+// Check the liveness of the replicas, warning when a replica stops pinging
+// and logging the membership table at the debug level.
+func (l *Leader) checkMembers() {
+	for _, member := range l.members {
+		if member.Alive && time.Since(member.Seen) >= ElectionTimeout {
+			warn("replica %s has not pinged in %s", member.Name, ElectionTimeout)
+			member.Alive = false
+		}
+	}
+
+	if logLevel <= Debug && time.Since(l.reported) >= MembershipReportInterval {
+		l.reported = time.Now()
+		debug("membership at state %d:\n%s", l.sequence, l.Membership())
+	}
+}
+
+//===========================================================================
+// Replica pings
+//===========================================================================
+
+// Ping the leader with the latest state applied if the interval has passed.
+func (r *Replica) ping() error {
+	if r.electing || r.snapshots == nil || time.Since(r.pinged) < HeartbeatInterval {
+		return nil
+	}
+
+	r.pinged = time.Now()
+	ping := &Message{
+		method:   MethodPing,
+		sequence: r.sequence,
+		term:     r.term,
+		key:      r.Name,
+		body:     nil,
+	}
+	return ping.Send(r.snapshots, nil)
+}
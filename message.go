@@ -1,56 +1,247 @@
 package dolly
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
 
 	zmq "github.com/pebbe/zmq4"
 )
 
+// Protocol header sent as the first frame of every message so that messages
+// from other applications or incompatible versions of dolly are rejected.
+const (
+	ProtocolMagic   = "DLY"
+	ProtocolVersion = 2
+)
+
+// Number of frames in a message, including the header frame.
+const messageFrames = 7
+
+// MaxPartSize is the largest part of a message that ReadMessage will read, so
+// that a corrupt or malicious length prefix cannot allocate gigabytes.
+const MaxPartSize = 64 << 20
+
+// The header frame for the current version of the protocol.
+var header = append([]byte(ProtocolMagic), ProtocolVersion)
+
 // RecvMessage off the socket, serializing correctly. If route is true,
-// then the message is read with the identity, otherwise it is treated as a
-// subscription message.
-func RecvMessage(sock *zmq.Socket, route bool) (*Message, []byte, error) {
+// then the message is read with the routing envelope of identities that
+// precede it, otherwise the message is expected to have no envelope. If the
+// message is malformed, a *ProtocolError is returned along with the routing
+// envelope (if it could be determined) so that an error can be sent back.
+func RecvMessage(sock *zmq.Socket, route bool) (*Message, [][]byte, error) {
 	parts, err := sock.RecvMessageBytes(0)
 	if err != nil {
 		return nil, nil, err
 	}
+	return splitMessage(parts, route)
+}
 
-	var identity []byte
+// Split the frames of a message into its routing envelope, if route is true,
+// and the message, as described by RecvMessage.
+func splitMessage(parts [][]byte, route bool) (*Message, [][]byte, error) {
+	var envelope [][]byte
 	if route {
-		identity = parts[0]
-		parts = parts[1:]
+		// The envelope is every frame before the header; if there is no
+		// header then the first frame is the identity of the sender. Whole
+		// frames are compared so that identities are never taken for it.
+		envelope = parts[:1]
+		for i, part := range parts {
+			if isHeader(part) {
+				envelope = parts[:i]
+				break
+			}
+		}
+		parts = parts[len(envelope):]
+	}
+
+	message, err := parseMessage(parts)
+	return message, envelope, err
+}
+
+// Receive a message published on a SUB socket, which is preceded by exactly
+// one frame with the topic it was published to.
+func recvPublished(sock *zmq.Socket) (*Message, error) {
+	parts, err := sock.RecvMessageBytes(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parts) == 0 {
+		return nil, protocolErrorf("no topic frame")
+	}
+	return parseMessage(parts[1:])
+}
+
+// Returns true if the frame is a protocol header of any version.
+func isHeader(part []byte) bool {
+	return len(part) == len(header) && bytes.HasPrefix(part, []byte(ProtocolMagic))
+}
+
+// Parse the frames of a message following its routing envelope or topic.
+func parseMessage(parts [][]byte) (*Message, error) {
+	if len(parts) != messageFrames {
+		return nil, protocolErrorf("expected %d frames, received %d", messageFrames, len(parts))
+	}
+
+	if !isHeader(parts[0]) {
+		return nil, protocolErrorf("bad protocol header %q", parts[0])
+	}
+
+	if version := parts[0][len(ProtocolMagic)]; version != ProtocolVersion {
+		return nil, protocolErrorf("unsupported protocol version %d", version)
+	}
+
+	if len(parts[2]) != 8 || len(parts[3]) != 8 {
+		return nil, protocolErrorf("sequence and term must be 8 bytes")
+	}
+
+	if len(parts[1]) == 0 {
+		return nil, protocolErrorf("no method specified")
+	}
+
+	options, err := url.ParseQuery(string(parts[6]))
+	if err != nil {
+		return nil, protocolErrorf("bad options: %s", err)
+	}
+
+	message := &Message{
+		method:   string(parts[1]),
+		sequence: binary.LittleEndian.Uint64(parts[2]),
+		term:     binary.LittleEndian.Uint64(parts[3]),
+		key:      string(parts[4]),
+		body:     parts[5],
+		options:  options,
+	}
+
+	return message, nil
+}
+
+// Returns ErrTooLarge if a part of the message is larger than MaxPartSize,
+// since it could not be read back by ReadMessage once it is written.
+func (m *Message) checkSize() error {
+	if len(m.key) > MaxPartSize || len(m.body) > MaxPartSize || len(m.options.Encode()) > MaxPartSize {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// ReadMessage from a file or other reader that was written by Message.Write.
+// Returns io.EOF if there are no more messages to read, or
+// io.ErrUnexpectedEOF if the reader ends in the middle of a message. Parts
+// larger than MaxPartSize, or than the bytes left in a reader that knows its
+// length (such as a bytes.Reader), are rejected before they are allocated.
+func ReadMessage(r io.Reader) (*Message, error) {
+	parts := make([][]byte, 6)
+	for i := range parts {
+		var size uint32
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			if err == io.EOF && i > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		if size > MaxPartSize {
+			return nil, fmt.Errorf("message part of %d bytes exceeds the maximum of %d", size, MaxPartSize)
+		}
+		if lr, ok := r.(interface{ Len() int }); ok && int(size) > lr.Len() {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		parts[i] = make([]byte, size)
+		if _, err := io.ReadFull(r, parts[i]); err != nil {
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+
+	if len(parts[1]) != 8 || len(parts[2]) != 8 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	options, err := url.ParseQuery(string(parts[5]))
+	if err != nil {
+		return nil, err
 	}
 
 	message := &Message{
 		method:   string(parts[0]),
 		sequence: binary.LittleEndian.Uint64(parts[1]),
-		key:      string(parts[2]),
-		body:     parts[3],
+		term:     binary.LittleEndian.Uint64(parts[2]),
+		key:      string(parts[3]),
+		body:     parts[4],
+		options:  options,
 	}
 
-	return message, identity, nil
+	return message, nil
 }
 
-// Message represents a message that can be read off the wire.
+// Message represents a message that can be read off the wire. Options carry
+// optional parameters of requests, such as the lease of a Put.
 type Message struct {
 	method   string
 	sequence uint64
+	term     uint64
 	key      string
 	body     []byte
+	options  url.Values
+}
+
+// String returns a description of the message for logging.
+func (m *Message) String() string {
+	switch m.method {
+	case MethodPut:
+		return fmt.Sprintf("%s %s=%s", m.method, m.key, m.body)
+	case MethodTxn:
+		ops, _ := decodeOps(m.body)
+		return fmt.Sprintf("%s of %d ops", m.method, len(ops))
+	default:
+		return fmt.Sprintf("%s %s", m.method, m.key)
+	}
 }
 
 // Send the message on the socket
-func (m *Message) Send(sock *zmq.Socket, route []byte) error {
-	// Convert the sequence into bytes
+func (m *Message) Send(sock *zmq.Socket, route [][]byte) error {
+	// Convert the sequence and term into bytes
 	seq := make([]byte, 8)
 	binary.LittleEndian.PutUint64(seq, m.sequence)
+	term := make([]byte, 8)
+	binary.LittleEndian.PutUint64(term, m.term)
 
-	// If we have the identity, send that first
-	if route != nil {
-		sock.SendBytes(route, zmq.SNDMORE)
+	// If we have the routing envelope, send that first
+	for _, identity := range route {
+		sock.SendBytes(identity, zmq.SNDMORE)
 	}
 
 	// Send the message on the wire
-	_, err := sock.SendMessageDontwait([]byte(m.method), seq, []byte(m.key), m.body)
+	_, err := sock.SendMessageDontwait(header, []byte(m.method), seq, term, []byte(m.key), m.body, []byte(m.options.Encode()))
 	return err
 }
+
+// Write the message to a file or other writer, prefixing each part with its
+// length so that it can be read back with ReadMessage.
+func (m *Message) Write(w io.Writer) error {
+	// Convert the sequence and term into bytes
+	seq := make([]byte, 8)
+	binary.LittleEndian.PutUint64(seq, m.sequence)
+	term := make([]byte, 8)
+	binary.LittleEndian.PutUint64(term, m.term)
+
+	parts := [][]byte{[]byte(m.method), seq, term, []byte(m.key), m.body, []byte(m.options.Encode())}
+	for _, part := range parts {
+		if err := binary.Write(w, binary.LittleEndian, uint32(len(part))); err != nil {
+			return err
+		}
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
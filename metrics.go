@@ -0,0 +1,296 @@
+// This file implements the metrics of a replica, which are exposed over HTTP
+// in the Prometheus text format if the replica is configured with a port.
+
+package dolly
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds in seconds of the buckets of the
+// histograms of request latency.
+var LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// Methods of the client requests that are counted and timed from the time the
+// request is received until it is replied to.
+var timedMethods = map[string]bool{
+	MethodGet: true, MethodScan: true, MethodPut: true, MethodDelete: true, MethodCAS: true, MethodTxn: true,
+	MethodGrant: true, MethodKeepAlive: true, MethodRevoke: true,
+}
+
+// metrics are the counters, histograms and gauges of a replica. They are
+// updated by the goroutine serving the replica (and the snapshotter) and read
+// by the HTTP server, so every field is guarded by the mutex. The metrics of
+// a replica that does not expose them are nil, and every method is a no-op.
+type metrics struct {
+	sync.Mutex
+	requests  map[string]uint64     // requests received by method
+	errors    map[string]uint64     // error replies by method
+	latency   map[string]*histogram // latency of the replies by method
+	pending   map[string]*timing    // requests waiting for a reply by client
+	sequence  uint64                // the latest state applied
+	term      uint64                // the term of the current leader
+	keys      int                   // the number of keys in the store
+	bytes     int64                 // the size of the store in bytes
+	leader    bool                  // if the replica is the leader
+	lag       map[string]uint64     // the states each replica is behind the leader
+	snapshots uint64                // snapshot transfers started
+	entries   uint64                // entries sent in snapshot transfers
+}
+
+// timing is a request that has been received but not replied to.
+type timing struct {
+	method   string
+	received time.Time
+}
+
+// histogram counts observations in cumulative buckets of LatencyBuckets.
+type histogram struct {
+	counts []uint64 // observations at or below each bucket
+	count  uint64   // all observations
+	sum    float64  // the sum of all observations
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: make(map[string]uint64),
+		errors:   make(map[string]uint64),
+		latency:  make(map[string]*histogram),
+		pending:  make(map[string]*timing),
+		lag:      make(map[string]uint64),
+	}
+}
+
+// Count a request from a client and start timing it until it is replied to.
+func (m *metrics) begin(msg *Message, route [][]byte) {
+	if m == nil || !timedMethods[msg.method] {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.requests[msg.method]++
+	m.pending[routeKey(route)] = &timing{method: msg.method, received: time.Now()}
+}
+
+// Observe the latency of the request the reply on the route is sent for,
+// counting it as an error if it is an error reply.
+func (m *metrics) end(rep *Message, route [][]byte) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	id := routeKey(route)
+	req, ok := m.pending[id]
+	if !ok {
+		return
+	}
+	delete(m.pending, id)
+
+	if rep.method == MethodError {
+		m.errors[req.method]++
+	}
+
+	h, ok := m.latency[req.method]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(LatencyBuckets))}
+		m.latency[req.method] = h
+	}
+	h.observe(time.Since(req.received).Seconds())
+}
+
+// Stop timing the requests that will not be replied to since the replica is
+// restarting in a new role.
+func (m *metrics) abandon() {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.pending = make(map[string]*timing)
+}
+
+// Count a snapshot transfer of the number of entries.
+func (m *metrics) snapshot(entries int) {
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.snapshots++
+	m.entries += uint64(entries)
+}
+
+// Record an observation in the histogram.
+func (h *histogram) observe(val float64) {
+	for i, bound := range LatencyBuckets {
+		if val <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += val
+}
+
+//===========================================================================
+// Replica gauges
+//===========================================================================
+
+// Update the gauges of the metrics with the state of the replica. The lag of a
+// replica is relative to the latest state of the leader it has heard of.
+func (r *Replica) observe() {
+	m := r.metrics
+	if m == nil {
+		return
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.sequence = r.sequence
+	m.term = r.term
+	m.keys = r.store.Len()
+	m.bytes = r.store.Bytes()
+	m.leader = false
+
+	m.lag = make(map[string]uint64)
+	if r.leading > r.sequence {
+		m.lag[r.Name] = r.leading - r.sequence
+	} else {
+		m.lag[r.Name] = 0
+	}
+}
+
+// Update the gauges of the metrics with the state of the leader and the lag
+// of every replica relative to it.
+func (l *Leader) observe() {
+	m := l.metrics
+	if m == nil {
+		return
+	}
+
+	members := l.Membership()
+
+	m.Lock()
+	defer m.Unlock()
+	m.sequence = l.sequence
+	m.term = l.term
+	m.keys = l.store.Len()
+	m.bytes = l.store.Bytes()
+	m.leader = true
+
+	m.lag = make(map[string]uint64, len(members))
+	for _, member := range members {
+		m.lag[member.Name] = member.Lag
+	}
+}
+
+//===========================================================================
+// Metrics endpoint
+//===========================================================================
+
+// Serve the metrics on the /metrics path of the port until the server fails.
+func (m *metrics) serve(port uint16) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+
+	addr := fmt.Sprintf(":%d", port)
+	info("serving metrics on http://%s/metrics", addr)
+	return http.ListenAndServe(addr, mux)
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m.Lock()
+	buf := new(bytes.Buffer)
+	m.write(buf)
+	m.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// Write the metrics in the text exposition format, ordered by label.
+func (m *metrics) write(buf *bytes.Buffer) {
+	describe(buf, "dolly_requests_total", "counter", "Requests received from clients by method.")
+	for _, method := range sortedKeys(m.requests) {
+		fmt.Fprintf(buf, "dolly_requests_total{method=%q} %d\n", method, m.requests[method])
+	}
+
+	describe(buf, "dolly_errors_total", "counter", "Error replies sent to clients by method.")
+	for _, method := range sortedKeys(m.errors) {
+		fmt.Fprintf(buf, "dolly_errors_total{method=%q} %d\n", method, m.errors[method])
+	}
+
+	describe(buf, "dolly_request_duration_seconds", "histogram", "Latency of requests from when they are received until they are replied to.")
+	methods := make([]string, 0, len(m.latency))
+	for method := range m.latency {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	for _, method := range methods {
+		h := m.latency[method]
+		for i, bound := range LatencyBuckets {
+			fmt.Fprintf(buf, "dolly_request_duration_seconds_bucket{method=%q,le=%q} %d\n", method, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(buf, "dolly_request_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, h.count)
+		fmt.Fprintf(buf, "dolly_request_duration_seconds_sum{method=%q} %g\n", method, h.sum)
+		fmt.Fprintf(buf, "dolly_request_duration_seconds_count{method=%q} %d\n", method, h.count)
+	}
+
+	describe(buf, "dolly_sequence", "gauge", "The latest state applied by the replica.")
+	fmt.Fprintf(buf, "dolly_sequence %d\n", m.sequence)
+
+	describe(buf, "dolly_term", "gauge", "The election term of the current leader.")
+	fmt.Fprintf(buf, "dolly_term %d\n", m.term)
+
+	describe(buf, "dolly_leader", "gauge", "Whether the replica is the leader.")
+	leader := 0
+	if m.leader {
+		leader = 1
+	}
+	fmt.Fprintf(buf, "dolly_leader %d\n", leader)
+
+	describe(buf, "dolly_store_keys", "gauge", "The number of keys in the store, including tombstones.")
+	fmt.Fprintf(buf, "dolly_store_keys %d\n", m.keys)
+
+	describe(buf, "dolly_store_bytes", "gauge", "The size of the store in bytes.")
+	fmt.Fprintf(buf, "dolly_store_bytes %d\n", m.bytes)
+
+	describe(buf, "dolly_replica_lag", "gauge", "The number of states a replica is behind the leader.")
+	for _, name := range sortedKeys(m.lag) {
+		fmt.Fprintf(buf, "dolly_replica_lag{replica=%q} %d\n", name, m.lag[name])
+	}
+
+	describe(buf, "dolly_snapshots_total", "counter", "Snapshot transfers started by the leader.")
+	fmt.Fprintf(buf, "dolly_snapshots_total %d\n", m.snapshots)
+
+	describe(buf, "dolly_snapshot_entries_total", "counter", "Entries sent in snapshot transfers by the leader.")
+	fmt.Fprintf(buf, "dolly_snapshot_entries_total %d\n", m.entries)
+}
+
+// Write the help and type lines of a metric.
+func describe(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Returns the keys of the map in sorted order.
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
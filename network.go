@@ -9,6 +9,8 @@ import (
 	"math/rand"
 	"os"
 	"os/signal"
+	"sort"
+	"syscall"
 	"time"
 
 	zmq "github.com/pebbe/zmq4"
@@ -26,13 +28,64 @@ func init() {
 
 // Method constants
 const (
-	MethodGet      = "Get"
-	MethodPut      = "Put"
+	MethodGet    = "Get"
+	MethodScan   = "Scan"
+	MethodPut    = "Put"
+	MethodDelete = "Delete"
+	MethodCAS    = "CompareAndSwap"
+	MethodTxn    = "Txn"
+	MethodCheck  = "Check"
+
+	MethodGrant     = "Grant"
+	MethodKeepAlive = "KeepAlive"
+	MethodRevoke    = "Revoke"
+	MethodWatch     = "Watch"
+	MethodUnwatch   = "Unwatch"
+	MethodStatus    = "Status"
+
 	MethodError    = "Error"
 	MethodSnapshot = "Snapshot"
+	MethodChunk    = "Chunk"
+	MethodRange    = "Range"
 	MethodTerm     = "Terminate"
+
+	MethodHeartbeat   = "Heartbeat"
+	MethodPing        = "Ping"
+	MethodAck         = "Ack"
+	MethodReadIndex   = "ReadIndex"
+	MethodElection    = "Election"
+	MethodAlive       = "Alive"
+	MethodCoordinator = "Coordinator"
 )
 
+// Timing constants for leader heartbeats and failure detection. Replicas
+// start an election if they have not heard from the leader in the election
+// timeout, which should be several heartbeat intervals; the leader considers
+// a replica down if it has not pinged in the election timeout.
+const (
+	HeartbeatInterval        = 500 * time.Millisecond
+	ElectionTimeout          = 4 * HeartbeatInterval
+	MembershipReportInterval = 30 * time.Second
+)
+
+// LogSize is the number of recent updates each replica keeps in memory so that
+// the leader can send replicas that miss updates (or restart) only the updates
+// they are missing rather than a full snapshot.
+const LogSize = 4096
+
+// RangeSize is the most updates the leader sends in reply to a range request.
+// A replica that is further behind requests the rest of the range once the
+// updates have arrived, so the leader never overflows the high water mark.
+const RangeSize = SnapshotChunkSize
+
+// Sent on the error channel by a serving leader or replica when the leader of
+// the network has changed so that the network can restart it in its new role.
+var errLeaderChanged = errors.New("leader of the network has changed")
+
+// Sent by the leader in reply to a snapshot or range request from a replica
+// with later state, which then elects a leader with the latest state.
+var errLeaderBehind = errors.New("leader is behind the replica")
+
 // New creates a Dolly network from the specified peers.json configuration.
 func New(peers string) (*Network, error) {
 
@@ -66,6 +119,15 @@ type Network struct {
 	leader  *Replica
 	peers   Replicas
 	context *zmq.Context
+	public  string // the CURVE public key of clients of the network
+	secret  string // the CURVE secret key of clients of the network
+}
+
+// SetKeypair sets the CURVE keypair that clients created by the network use
+// to connect to replicas that are configured with keypairs.
+func (n *Network) SetKeypair(public, secret string) {
+	n.public = public
+	n.secret = secret
 }
 
 // Run a replica or leader with the specified name.
@@ -82,31 +144,54 @@ func (n *Network) Run(name string) (err error) {
 	if n.local, err = n.peers.Get(name); err != nil {
 		return err
 	}
+	n.local.network = n
+	n.local.started = time.Now()
+
+	// Authenticate CURVE connections before any sockets are bound
+	if err = n.authenticate(); err != nil {
+		return err
+	}
 
 	// Create the error channel and signal handlers
 	echan := make(chan error)
-	notify := make(chan os.Signal)
-	signal.Notify(notify)
+	notify := make(chan os.Signal, 1)
+	signal.Notify(notify, os.Interrupt, syscall.SIGTERM)
 
-	// Figure out if we're the leader or not
-	if n.local == n.leader {
-		// Run as leader
-		leader := &Leader{*n.local}
-		go leader.Serve(n.context, echan)
-	} else {
-		// Run as replica
-		go n.local.Serve(n.leader, n.context, echan)
+	// Serve the metrics of the local replica if it is configured with a port
+	if n.local.Metrics > 0 {
+		n.local.metrics = newMetrics()
+		go func() {
+			echan <- n.local.metrics.serve(n.local.Metrics)
+		}()
 	}
 
-	// Listen for errors
-	select {
-	case err := <-echan:
-		return err
-	case <-notify:
-		os.Exit(0)
+	// Run as the leader or a replica
+	go n.serve(echan)
+
+	// Listen for errors, restarting the server if the leader changes
+	for {
+		select {
+		case err := <-echan:
+			if err != errLeaderChanged {
+				return err
+			}
+			info("leader changed to %s, restarting", n.leader.Name)
+			go n.serve(echan)
+		case <-notify:
+			os.Exit(0)
+		}
+	}
+}
+
+// Serve the local replica either as the leader or as a replica of the leader.
+func (n *Network) serve(echan chan<- error) {
+	if n.local == n.leader {
+		leader := &Leader{Replica: n.local}
+		leader.Serve(n.context, echan)
+		return
 	}
 
-	return nil
+	n.local.Serve(n.leader, n.context, echan)
 }
 
 // Client returns a client connection for the specified replica.
@@ -116,18 +201,37 @@ func (n *Network) Client(name string) (*Client, error) {
 		return nil, err
 	}
 
-	return &Client{replica: replica}, nil
+	return &Client{replica: replica, retries: RequestRetries, public: n.public, secret: n.secret}, nil
+}
+
+// Cluster returns a client that connects to every replica in the network.
+func (n *Network) Cluster() *Cluster {
+	cluster := &Cluster{
+		clients: make([]*Client, 0, len(n.peers)),
+	}
+
+	// Order the clients by PID, the order in which replicas become leader
+	for _, replica := range n.peers.Sorted() {
+		cluster.clients = append(cluster.clients, &Client{replica: replica, retries: 0, public: n.public, secret: n.secret})
+	}
+
+	return cluster
 }
 
 // Replicas represents a collection of replicas.
 type Replicas []*Replica
 
-// Leader returns the replica that has the lowest PID.
+// Leader returns the replica that has the lowest PID and holds the entire
+// store; partial replicas cannot be the leader.
 func (r Replicas) Leader() (*Replica, error) {
 	var err error
 	var leader *Replica
 
 	for _, replica := range r {
+		if replica.partial() {
+			continue
+		}
+
 		if leader == nil {
 			leader = replica
 		} else if replica.PID == leader.PID {
@@ -138,11 +242,19 @@ func (r Replicas) Leader() (*Replica, error) {
 	}
 
 	if leader == nil {
-		err = errors.New("no replicas configured")
+		err = errors.New("no replicas configured without subtrees")
 	}
 	return leader, err
 }
 
+// Sorted returns a copy of the replicas ordered by PID.
+func (r Replicas) Sorted() Replicas {
+	sorted := make(Replicas, len(r))
+	copy(sorted, r)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].PID < sorted[j].PID })
+	return sorted
+}
+
 // Get a replica by name, returns nil if not found.
 func (r Replicas) Get(name string) (*Replica, error) {
 	for _, replica := range r {
@@ -0,0 +1,67 @@
+package dolly
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Names of the options that can be set on a message.
+const (
+	optLease   = "lease"
+	optTTL     = "ttl"
+	optSubtree = "subtree"
+	optPrefix  = "prefix"
+	optStart   = "start"
+	optEnd     = "end"
+	optLimit   = "limit"
+	optCursor  = "cursor"
+	optConcern = "concern"
+	optLeader  = "leader"
+
+	optConsistency = "consistency"
+	optMinSequence = "min_sequence"
+	optLastTerm    = "last_term"
+)
+
+// Option sets an optional parameter on a request.
+type Option func(*Message)
+
+// WithTTL deletes the key after the ttl expires, unless it is written again.
+func WithTTL(ttl time.Duration) Option {
+	return func(m *Message) {
+		m.set(optTTL, ttl.String())
+	}
+}
+
+// WithLease attaches the key to a lease so that it is deleted when the lease
+// expires or is revoked, unless it is written again without the lease.
+func WithLease(id LeaseID) Option {
+	return func(m *Message) {
+		m.set(optLease, strconv.FormatUint(uint64(id), 10))
+	}
+}
+
+// Set an option on the message.
+func (m *Message) set(name, value string) {
+	if m.options == nil {
+		m.options = make(url.Values)
+	}
+	m.options.Set(name, value)
+}
+
+// Add a value to an option that can have multiple values.
+func (m *Message) add(name, value string) {
+	if m.options == nil {
+		m.options = make(url.Values)
+	}
+	m.options.Add(name, value)
+}
+
+// Apply the options to the message.
+func (m *Message) apply(opts []Option) *Message {
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
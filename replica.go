@@ -1,7 +1,9 @@
 package dolly
 
 import (
+	"encoding/binary"
 	"fmt"
+	"sort"
 	"time"
 
 	zmq "github.com/pebbe/zmq4"
@@ -10,21 +12,57 @@ import (
 // Replica defines a peer on the network that can respond to Get requests
 // and synchronizes state by subscribing to the leader.
 type Replica struct {
-	PID       uint16 `json:"pid"`       // the precedence id of the peer
-	Name      string `json:"name"`      // unique name of the peer
-	Addr      string `json:"address"`   // the network address of the peer
-	Host      string `json:"host"`      // the hostname of the peer
-	IPAddr    string `json:"ipaddr"`    // the ip address of the peer
-	Updates   uint16 `json:"updates"`   // the port the replica publishes updates on
-	Snapshots uint16 `json:"snapshots"` // the port the replica fetches snapshots on
-	Requests  uint16 `json:"requests"`  // the port the replica handles requests on
-
-	store     map[string]*Message // the key/value store representing state
-	sequence  uint64              // the order of states as applied
-	context   *zmq.Context        // the zmq context to create sockets with
-	updates   *zmq.Socket         // socket to bind PUB/SUB on
-	snapshots *zmq.Socket         // socket to bind ROUTER/DEALER on
-	requests  *zmq.Socket         // socket to bind ROUTER on for clients
+	PID       uint16   `json:"pid"`        // the precedence id of the peer
+	Name      string   `json:"name"`       // unique name of the peer
+	Addr      string   `json:"address"`    // the network address of the peer
+	Host      string   `json:"host"`       // the hostname of the peer
+	IPAddr    string   `json:"ipaddr"`     // the ip address of the peer
+	Updates   uint16   `json:"updates"`    // the port the replica publishes updates on
+	Snapshots uint16   `json:"snapshots"`  // the port the replica fetches snapshots on
+	Requests  uint16   `json:"requests"`   // the port the replica handles requests on
+	Data      string   `json:"data"`       // optional directory to persist the store in
+	Wait      bool     `json:"wait"`       // wait for forwarded writes to be applied before replying
+	Subtrees  []string `json:"subtrees"`   // prefixes of the keys held by the replica, all if empty
+	Engine    string   `json:"engine"`     // the storage engine of the store, memory by default
+	Metrics   uint16   `json:"metrics"`    // optional port to serve metrics over HTTP on
+	PublicKey string   `json:"public_key"` // optional CURVE public key of the replica (Z85)
+	SecretKey string   `json:"secret_key"` // CURVE secret key, only needed by the replica itself
+	Clients   []string `json:"clients"`    // CURVE public keys of the clients allowed to connect
+
+	store     Store                  // the key/value store representing state
+	deleted   map[string]uint64      // the state of each tombstone in the store, nil until indexed
+	purged    uint64                 // tombstones up to this state have been purged
+	sequence  uint64                 // the order of states as applied
+	pending   map[uint64]*Message    // updates received ahead of their sequence
+	log       []*Message             // the most recent updates in sequence order
+	wal       *wal                   // write-ahead log of updates in the data directory
+	catching  bool                   // if a range of missing updates was requested
+	download  *download              // the snapshot being fetched from the leader, if any
+	catchEnd  uint64                 // the end of the range of missing updates
+	caught    time.Time              // when the range is requested again if unanswered
+	term      uint64                 // the election term of the current leader
+	lastTerm  uint64                 // the term of the leader that sequenced the latest state
+	leading   uint64                 // the latest state of the leader that has been heard of
+	metrics   *metrics               // the metrics of the replica, nil if not exposed
+	network   *Network               // the network the replica is a member of
+	context   *zmq.Context           // the zmq context to create sockets with
+	updates   *zmq.Socket            // socket to bind PUB/SUB on
+	snapshots *zmq.Socket            // socket to bind ROUTER/DEALER on
+	requests  *zmq.Socket            // socket to bind ROUTER on for clients
+	forwards  *zmq.Socket            // socket to forward writes to the leader on
+	waiting   []*forward             // forwarded replies waiting for their update
+	reads     []*read                // reads waiting for the replica to apply a state
+	indexes   uint64                 // the number of read index requests sent
+	watchers  map[string]*watcher    // clients streaming changes from the replica
+	conns     map[string]*zmq.Socket // sockets to send messages to peers on
+	started   time.Time              // when the process serving the replica started
+	heard     time.Time              // last time a message arrived from the leader
+	pinged    time.Time              // last time the replica pinged the leader
+	acked     uint64                 // the latest state acked to the leader
+	electing  bool                   // if the replica is running an election
+	alive     bool                   // if a peer that outranks the replica answered the election
+	answered  map[string]bool        // the peers that answered the current election
+	deadline  time.Time              // when the current election times out
 }
 
 // Serve requests and subscribe to the leader to get updates.
@@ -33,7 +71,21 @@ func (r *Replica) Serve(leader *Replica, ctx *zmq.Context, echan chan<- error) {
 
 	// Initialize the store and save state
 	r.context = ctx
-	r.store = make(map[string]*Message)
+	if r.store == nil {
+		if r.store, err = r.openStore(); err != nil {
+			echan <- err
+			return
+		}
+	}
+	r.pending = make(map[uint64]*Message)
+	r.catching = false
+	r.metrics.abandon()
+
+	// Recover the store from disk if this is the first time serving
+	if err = r.Recover(); err != nil {
+		echan <- err
+		return
+	}
 
 	// Connect to the leader
 	if err = r.Connect(leader); err != nil {
@@ -47,21 +99,35 @@ func (r *Replica) Serve(leader *Replica, ctx *zmq.Context, echan chan<- error) {
 		return
 	}
 
-	// Send snapshot request to get up to date with the leader
+	// Start the failure detector for the leader and ack the new leader
+	r.heard = time.Now()
+	r.electing = false
+	r.acked = 0
+
+	// Send snapshot request to get up to date, which only fetches the updates
+	// missed while offline (or serving another role) if the leader has them
 	if err = r.Snapshot(); err != nil {
 		echan <- err
 		return
 	}
 
-	// Create a poller to handle updates and requests
+	// Create a poller to handle updates, catchup, and requests
 	poller := zmq.NewPoller()
 	poller.Add(r.updates, zmq.POLLIN)
+	poller.Add(r.snapshots, zmq.POLLIN)
 	poller.Add(r.requests, zmq.POLLIN)
+	poller.Add(r.forwards, zmq.POLLIN)
 
-	// Run the replica server forever
+	// Run the replica server until the leader changes
 	for {
-		// Poll the sockets with a 1 second timeout
-		items, err := poller.Poll(time.Second * 1)
+		// Poll the sockets with a heartbeat interval timeout, or more often
+		// if reads are held so that they time out promptly
+		timeout := HeartbeatInterval
+		if len(r.reads) > 0 {
+			timeout = pollInterval
+		}
+
+		items, err := poller.Poll(timeout)
 		if err != nil {
 			echan <- err
 			return
@@ -86,6 +152,38 @@ func (r *Replica) Serve(leader *Replica, ctx *zmq.Context, echan chan<- error) {
 				}
 			}
 
+			// Handle missing updates
+			if item.Socket == r.snapshots {
+				if err := r.onSnapshots(); err != nil {
+					echan <- err
+					return
+				}
+			}
+
+			// Handle replies to forwarded writes
+			if item.Socket == r.forwards {
+				if err := r.onForwards(); err != nil {
+					echan <- err
+					return
+				}
+			}
+
+		}
+
+		// Ack the updates applied and ping the leader with the local state
+		if err := r.ack(); err != nil {
+			echan <- err
+			return
+		}
+		if err := r.ping(); err != nil {
+			echan <- err
+			return
+		}
+
+		// Check if the leader has failed
+		if err := r.onTick(); err != nil {
+			echan <- err
+			return
 		}
 	}
 }
@@ -99,6 +197,9 @@ func (r *Replica) Connect(leader *Replica) (err error) {
 	if err = r.snapshots.SetLinger(0); err != nil {
 		return err
 	}
+	if err = r.connectCurve(r.snapshots, leader); err != nil {
+		return err
+	}
 	endpoint := fmt.Sprintf("tcp://%s:%d", leader.Addr, leader.Snapshots)
 	if err = r.snapshots.Connect(endpoint); err != nil {
 		return err
@@ -112,7 +213,10 @@ func (r *Replica) Connect(leader *Replica) (err error) {
 	if err = r.updates.SetLinger(0); err != nil {
 		return err
 	}
-	if err = r.updates.SetSubscribe(""); err != nil {
+	if err = r.subscribe(); err != nil {
+		return err
+	}
+	if err = r.connectCurve(r.updates, leader); err != nil {
 		return err
 	}
 	endpoint = fmt.Sprintf("tcp://%s:%d", leader.Addr, leader.Updates)
@@ -121,15 +225,59 @@ func (r *Replica) Connect(leader *Replica) (err error) {
 	}
 	info("connected updates SUB socket to %s", endpoint)
 
+	// Create the forwards socket
+	if r.forwards, err = r.context.NewSocket(zmq.DEALER); err != nil {
+		return err
+	}
+	if err = r.forwards.SetLinger(0); err != nil {
+		return err
+	}
+	if err = r.connectCurve(r.forwards, leader); err != nil {
+		return err
+	}
+	endpoint = fmt.Sprintf("tcp://%s:%d", leader.Addr, leader.Requests)
+	if err = r.forwards.Connect(endpoint); err != nil {
+		return err
+	}
+	info("connected forwards DEALER socket to %s", endpoint)
+
+	return nil
+}
+
+// Disconnect closes the sockets to the leader (or the sockets bound by the
+// leader) so that the replica can connect to a new leader. Any writes that
+// were forwarded to the old leader are abandoned and clients must retry.
+func (r *Replica) Disconnect() error {
+	for _, sock := range []*zmq.Socket{r.snapshots, r.updates, r.forwards} {
+		if sock == nil {
+			continue
+		}
+		if err := sock.Close(); err != nil {
+			return err
+		}
+	}
+
+	r.snapshots = nil
+	r.updates = nil
+	r.forwards = nil
+	r.waiting = nil
+	r.abandon()
 	return nil
 }
 
-// Bind the requests endpoint
+// Bind the requests endpoint, which remains bound if the replica changes role.
 func (r *Replica) Bind() (err error) {
+	if r.requests != nil {
+		return nil
+	}
+
 	// Create the requests socket
 	if r.requests, err = r.context.NewSocket(zmq.ROUTER); err != nil {
 		return err
 	}
+	if err = r.serveCurve(r.requests); err != nil {
+		return err
+	}
 	endpoint := fmt.Sprintf("tcp://*:%d", r.Requests)
 	if err = r.requests.Bind(endpoint); err != nil {
 		return err
@@ -139,106 +287,482 @@ func (r *Replica) Bind() (err error) {
 	return nil
 }
 
-// Snapshot sends a snapshot request to the server to become up to date.
-func (r *Replica) Snapshot() (err error) {
-	req := &Message{
-		method:   MethodSnapshot,
-		sequence: r.sequence,
-		key:      "",
-		body:     nil,
+// Handle a request from a client.
+func (r *Replica) onRequests() error {
+	// Get the message from the socket
+	msg, route, user, err := r.recvRequest(r.requests)
+	if err != nil {
+		if perr, ok := err.(*ProtocolError); ok {
+			warne(perr)
+			return r.sendError(r.requests, route, "", perr)
+		}
+		return err
 	}
+	r.metrics.begin(msg, route)
 
-	// Send the snapshot request
-	if err := req.Send(r.snapshots, nil); err != nil {
-		return err
+	// Mux the request correctly
+	switch msg.method {
+	case MethodGet, MethodScan:
+		return r.onRead(msg, route)
+	case MethodWatch:
+		return r.onWatch(msg, route)
+	case MethodUnwatch:
+		return r.onUnwatch(msg, route)
+	case MethodStatus:
+		return r.onStatus(msg, route)
+	case MethodPut, MethodDelete, MethodCAS, MethodTxn, MethodGrant, MethodKeepAlive, MethodRevoke:
+		return r.onForward(msg, route)
+	case MethodElection, MethodAlive, MethodCoordinator:
+		return r.onControl(msg, user)
+	default:
+		return r.sendError(r.requests, route, msg.key, protocolErrorf("unknown request method %s", msg.method))
 	}
+}
 
-	// Handle all the snapshots being sent back
-	keys := 0
-	for {
-		msg, _, err := RecvMessage(r.snapshots, false)
-		if err != nil {
-			return err
+// Handle an election message from a peer, dropping it if it was not sent with
+// the key of the peer.
+func (r *Replica) onControl(msg *Message, user string) error {
+	if !r.fromPeer(msg, user) {
+		return nil
+	}
+
+	switch msg.method {
+	case MethodElection:
+		return r.onElection(msg)
+	case MethodAlive:
+		return r.onAlive(msg)
+	default:
+		return r.onCoordinator(msg)
+	}
+}
+
+// Handle an update from the leader.
+func (r *Replica) onUpdates() error {
+	// Updates are published with their topic before the message
+	msg, err := recvPublished(r.updates)
+	if err != nil {
+		return dropProtocolError(err)
+	}
+
+	// Fence off messages from a stale leader
+	if msg.term < r.term {
+		return nil
+	}
+	r.term = msg.term
+	r.heard = time.Now()
+	if msg.sequence > r.leading {
+		r.leading = msg.sequence
+	}
+
+	// Heartbeats let us know the leader is alive and if we missed updates
+	if msg.method == MethodHeartbeat {
+		return r.onHeartbeat(msg)
+	}
+
+	return r.apply(msg)
+}
+
+// Handle a heartbeat from the leader by collecting tombstones that every
+// replica has applied and catching up if any updates have been missed.
+func (r *Replica) onHeartbeat(msg *Message) error {
+	// Ping the leader promptly so that it can confirm its leadership
+	r.pinged = time.Time{}
+
+	if len(msg.body) == 8 {
+		r.purge(binary.LittleEndian.Uint64(msg.body))
+	}
+
+	// The range of a partial replica is filtered by its subtrees, so it only
+	// holds the updates of its subtrees that it missed, if any
+	if msg.sequence > r.sequence {
+		return r.catchup(msg.sequence + 1)
+	}
+	return nil
+}
+
+// Remove tombstones from the store that were written at or before the state.
+// Every replica has applied the deletes by then, so they no longer need to be
+// sent in snapshots. Tombstones are found in an index rather than by scanning
+// the store, and only once the state has advanced since the last purge.
+func (r *Replica) purge(watermark uint64) {
+	if watermark <= r.purged {
+		return
+	}
+
+	if r.deleted == nil {
+		if err := r.indexTombstones(); err != nil {
+			warne(err)
+			return
 		}
+	}
+	r.purged = watermark
 
-		// If this is the terminate message then collect sequence
-		if msg.method == MethodTerm {
-			r.sequence = msg.sequence
-			info("received %d keys and up to date with snapshot %d", keys, r.sequence)
-			return nil
+	purged := 0
+	for key, sequence := range r.deleted {
+		if sequence > watermark {
+			continue
+		}
+		if err := r.store.Delete(key); err != nil {
+			warne(err)
+			continue
 		}
+		delete(r.deleted, key)
+		purged++
+	}
 
-		// Otherwise handle the update
-		keys++
-		r.store[msg.key] = msg
+	if purged > 0 {
+		debug("collected %d tombstones up to state %d", purged, watermark)
 	}
 }
 
-// Handle a request from a client.
-func (r *Replica) onRequests() error {
-	// Get the message from the socket
-	msg, route, err := RecvMessage(r.requests, true)
-	if err != nil {
+// Index the tombstones in the store by scanning it, which is only done the
+// first time tombstones are purged after the store is opened or replaced.
+func (r *Replica) indexTombstones() error {
+	tombstones := make(map[string]uint64)
+	if err := r.store.Iterate("", func(val *Message) bool {
+		if val.method == MethodDelete {
+			tombstones[val.key] = val.sequence
+		}
+		return true
+	}); err != nil {
 		return err
 	}
 
-	// Mux the request correctly
+	r.deleted = tombstones
+	return nil
+}
+
+// Track an entry put in the store in the index of tombstones, if it is built.
+func (r *Replica) track(msg *Message) {
+	if r.deleted == nil {
+		return
+	}
+
+	if msg.method == MethodDelete {
+		r.deleted[msg.key] = msg.sequence
+	} else {
+		delete(r.deleted, msg.key)
+	}
+}
+
+// Handle the updates sent by the leader in response to a range request and
+// the replies to read index requests.
+func (r *Replica) onSnapshots() error {
+	msg, _, err := RecvMessage(r.snapshots, false)
+	if err != nil {
+		return dropProtocolError(err)
+	}
+
+	// The chunks and replies of snapshot transfers are keyed by the id of the
+	// transfer rather than empty like the replies to ranges, so drop those of
+	// abandoned transfers
+	if msg.method == MethodChunk || (msg.key != "" && (msg.method == MethodTerm || msg.method == MethodError)) {
+		if r.download == nil || msg.key != r.download.id {
+			return nil
+		}
+		return r.onTransfer(msg)
+	}
+
 	switch msg.method {
-	case MethodGet:
-		return r.onGet(msg, route)
-	case MethodPut:
-		return r.onPut(msg, route)
+	case MethodTerm:
+		r.catching = false
+
+		// The snapshot being fetched replaces the state the range was for
+		if r.download != nil {
+			return nil
+		}
+
+		if msg.sequence < r.sequence {
+			// A leader with older state must not replace the state of the
+			// replica, which may hold acknowledged writes, so elect a leader
+			// with the latest state instead
+			if r.latest().after(positionOf(msg)) {
+				warn("leader is at state %d behind local state %d", msg.sequence, r.sequence)
+				return r.elect()
+			}
+
+			// The replica applied updates of an earlier term that the leader
+			// never sequenced, so its state must be replaced
+			warn("local state %d diverged from the leader at state %d", r.sequence, msg.sequence)
+			return r.Snapshot()
+		}
+
+		// The range of a partial replica skips the updates of other subtrees,
+		// so it has every update of its subtrees up to the state covered
+		if r.partial() && len(msg.body) == 16 {
+			covered := binary.LittleEndian.Uint64(msg.body[:8])
+			if err := r.advance(covered, binary.LittleEndian.Uint64(msg.body[8:])); err != nil {
+				return err
+			}
+		}
+
+		// Request the rest of the range if the leader sent part of it
+		if r.sequence+1 < r.catchEnd {
+			return r.catchup(r.catchEnd)
+		}
+
+		// Request the next gap if updates are still missing
+		for seq := range r.pending {
+			return r.catchup(seq)
+		}
+		return nil
+	case MethodReadIndex:
+		return r.onReadIndex(msg)
+	case MethodError:
+		r.catching = false
+		if string(msg.body) == errLeaderBehind.Error() {
+			warn("leader is behind local state %d", r.sequence)
+			return r.elect()
+		}
+
+		// The leader no longer has the updates, so fetch a full snapshot; the
+		// updates buffered are applied once it is installed
+		warn("could not catch up from state %d: %s", r.sequence, msg.body)
+		return r.Snapshot()
 	default:
-		return fmt.Errorf("unknown request method %s", msg.method)
+		return r.apply(msg)
 	}
 }
 
-// Handle an update from the leader.
-func (r *Replica) onUpdates() error {
-	msg, _, err := RecvMessage(r.updates, false)
-	if err != nil {
+// Apply an update from the leader in sequence order. Updates that arrive
+// ahead of the next sequence, or while a snapshot is fetched, are buffered and
+// the missing range is requested from the leader; updates that have already
+// been applied are discarded. A partial replica does not receive the updates
+// of other subtrees, so its ranges are filtered by its subtrees and it
+// advances past the updates of other subtrees once the range arrives.
+func (r *Replica) apply(msg *Message) error {
+	if msg.sequence <= r.sequence {
+		return nil
+	}
+
+	if msg.sequence > r.sequence+1 || r.download != nil {
+		r.pending[msg.sequence] = msg
+		return r.catchup(msg.sequence)
+	}
+
+	if err := r.commit(msg); err != nil {
 		return err
 	}
 
-	// Discard out of sequence messages
-	// TODO: handle catchup better
-	if msg.sequence > r.sequence {
-		r.sequence = msg.sequence
-		r.store[msg.key] = msg
-		info("received update to state %d %s=%s", msg.sequence, msg.key, msg.body)
+	if err := r.release(); err != nil {
+		return err
 	}
 
+	// Apply the next buffered update if it is now in sequence
+	if next, ok := r.pending[r.sequence+1]; ok {
+		delete(r.pending, next.sequence)
+		return r.apply(next)
+	}
 	return nil
 }
 
+// Commit an update in sequence to the store, the log, and the data directory.
+func (r *Replica) commit(msg *Message) error {
+	if err := r.update(msg); err != nil {
+		return err
+	}
+	r.sequence = msg.sequence
+	r.lastTerm = msg.term
+	r.record(msg)
+	info("received update to state %d %s", msg.sequence, msg)
+
+	return r.persist(msg)
+}
+
+// Advance a partial replica to the last state covered by a range, committing
+// the buffered updates of its subtrees up to it in sequence order, since the
+// updates between them were of other subtrees. The term is the term of the
+// update at the covered state.
+func (r *Replica) advance(covered, term uint64) error {
+	buffered := make([]uint64, 0, len(r.pending))
+	for seq := range r.pending {
+		if seq <= covered {
+			buffered = append(buffered, seq)
+		}
+	}
+	sort.Slice(buffered, func(i, j int) bool { return buffered[i] < buffered[j] })
+
+	for _, seq := range buffered {
+		msg := r.pending[seq]
+		delete(r.pending, seq)
+		if seq <= r.sequence {
+			continue
+		}
+		if err := r.commit(msg); err != nil {
+			return err
+		}
+	}
+
+	if covered > r.sequence {
+		r.sequence = covered
+		r.lastTerm = term
+	}
+	if err := r.release(); err != nil {
+		return err
+	}
+
+	// Apply the next buffered update if it is now in sequence
+	if next, ok := r.pending[r.sequence+1]; ok {
+		delete(r.pending, next.sequence)
+		return r.apply(next)
+	}
+	return nil
+}
+
+// Append an applied update to the log of recent updates, dropping the oldest
+// update if the log is full. The log is kept by replicas as well as the leader
+// so that a newly elected leader can catch replicas up from it.
+func (r *Replica) record(msg *Message) {
+	r.log = append(r.log, msg)
+	if len(r.log) > LogSize {
+		r.log = r.log[1:]
+	}
+}
+
+// Returns true if the log holds every update after the sequence.
+func (r *Replica) logged(sequence uint64) bool {
+	if sequence >= r.sequence {
+		return true
+	}
+	return len(r.log) > 0 && r.log[0].sequence <= sequence+1
+}
+
+// Returns the term of the leader that sequenced the update at the sequence,
+// and false if the update is not in the log.
+func (r *Replica) termAt(sequence uint64) (uint64, bool) {
+	switch {
+	case sequence == r.sequence:
+		return r.lastTerm, true
+	case sequence == 0:
+		return 0, true
+	}
+
+	i := sort.Search(len(r.log), func(i int) bool { return r.log[i].sequence >= sequence })
+	if i < len(r.log) && r.log[i].sequence == sequence {
+		return r.log[i].term, true
+	}
+	return 0, false
+}
+
+// Returns true if the state at the position is in the history of the log, so
+// that the updates in the log after it can be applied to it. The update at
+// the position must have been sequenced in the same term as the update in the
+// log, otherwise the state diverged after a change of leader.
+func (r *Replica) follows(pos position) bool {
+	if !r.logged(pos.sequence) {
+		return false
+	}
+	term, ok := r.termAt(pos.sequence)
+	return ok && term == pos.term
+}
+
+// Request the updates after the current sequence and before the specified
+// sequence from the leader. Only one range request is outstanding at a time,
+// and none while a snapshot is fetched.
+func (r *Replica) catchup(end uint64) error {
+	if r.catching || r.download != nil {
+		return nil
+	}
+
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint64(body, end)
+
+	req := r.mark(&Message{
+		method:   MethodRange,
+		sequence: r.sequence,
+		term:     r.term,
+		key:      "",
+		body:     body,
+	})
+
+	if err := r.filter(req).Send(r.snapshots, nil); err != nil {
+		return err
+	}
+
+	r.catching = true
+	r.catchEnd = end
+	r.caught = time.Now().Add(SnapshotTimeout)
+	info("missing states %d to %d, requesting range from leader", r.sequence+1, end-1)
+	return nil
+}
+
+// Request the range of missing updates again if the leader has not finished
+// sending it before the snapshot timeout, since its reply may have been lost.
+func (r *Replica) recatch() error {
+	if !r.catching || time.Now().Before(r.caught) {
+		return nil
+	}
+
+	warn("no reply to range request in %s, requesting it again", SnapshotTimeout)
+	r.catching = false
+	return r.catchup(r.catchEnd)
+}
+
 // Handle a Get request from a client
-func (r *Replica) onGet(msg *Message, route []byte) error {
-	var rep *Message
-	var ok bool
+func (r *Replica) onGet(msg *Message, route [][]byte) error {
+	if !r.holds(msg.key) {
+		return r.sendError(r.requests, route, msg.key, ErrNotReplicated)
+	}
 
 	// Just send the local state back
-	rep, ok = r.store[msg.key]
-	if !ok {
-		rep = &Message{
-			method:   MethodError,
-			sequence: r.sequence,
-			key:      msg.key,
-			body:     []byte("key not found"),
-		}
+	rep, ok := r.store.Get(msg.key)
+	if !ok || rep.method == MethodDelete {
+		return r.sendError(r.requests, route, msg.key, ErrNotFound)
 	}
 
 	// Send the message back
-	return rep.Send(r.requests, route)
+	return r.respond(rep, route)
 }
 
-// Handle a Put request from a client
-func (r *Replica) onPut(msg *Message, route []byte) error {
-	rep := &Message{
-		method:   MethodError,
-		sequence: r.sequence,
-		key:      msg.key,
-		body:     []byte(fmt.Sprintf("not the leader cannot put value")),
+// Handle a write request from a client by forwarding it to the leader.
+func (r *Replica) onForward(msg *Message, route [][]byte) error {
+	// Cannot forward while the leader is being elected
+	if r.electing || r.forwards == nil {
+		return r.sendError(r.requests, route, msg.key, ErrNotLeader)
+	}
+
+	debug("forwarding %s %s to the leader", msg.method, msg.key)
+	return msg.Send(r.forwards, route)
+}
+
+// Handle the reply from the leader to a forwarded write by relaying it to the
+// client, waiting until the write has been applied if required.
+func (r *Replica) onForwards() error {
+	rep, route, err := RecvMessage(r.forwards, true)
+	if err != nil {
+		return dropProtocolError(err)
+	}
+
+	if r.Wait && rep.method != MethodError && rep.sequence > r.sequence {
+		r.waiting = append(r.waiting, &forward{rep, route})
+		return nil
+	}
+
+	return r.respond(rep, route)
+}
+
+// Relay the replies to forwarded writes that have now been applied and serve
+// the reads that were waiting for the state.
+func (r *Replica) release() error {
+	waiting := r.waiting[:0]
+	for _, fwd := range r.waiting {
+		if fwd.reply.sequence > r.sequence {
+			waiting = append(waiting, fwd)
+			continue
+		}
+
+		if err := r.respond(fwd.reply, fwd.route); err != nil {
+			return err
+		}
 	}
 
-	return rep.Send(r.requests, route)
+	r.waiting = waiting
+	return r.answer()
+}
+
+// forward is the reply to a write forwarded to the leader along with the
+// route of the client that made the request.
+type forward struct {
+	reply *Message
+	route [][]byte
 }
@@ -0,0 +1,202 @@
+// This file implements ordered scans over ranges of keys, which are served
+// by iterating over the store in key order.
+
+package dolly
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DefaultScanLimit is the number of keys returned in a page of a scan if the
+// request does not specify a limit.
+const DefaultScanLimit = 100
+
+// KeyValue is a key returned by a scan along with its value and version.
+type KeyValue struct {
+	Key     string
+	Value   []byte
+	Version Version
+}
+
+// WithPrefix limits a scan to the keys that begin with the prefix.
+func WithPrefix(prefix string) Option {
+	return func(m *Message) {
+		m.set(optPrefix, prefix)
+	}
+}
+
+// WithRange limits a scan to the keys from start (inclusive) up to end
+// (exclusive). An empty start or end leaves that side of the range unbounded.
+func WithRange(start, end string) Option {
+	return func(m *Message) {
+		m.set(optStart, start)
+		m.set(optEnd, end)
+	}
+}
+
+// WithLimit sets the maximum number of keys returned in a page of a scan.
+func WithLimit(limit int) Option {
+	return func(m *Message) {
+		m.set(optLimit, strconv.Itoa(limit))
+	}
+}
+
+// WithCursor continues a scan after the cursor returned by the previous page.
+func WithCursor(cursor string) Option {
+	return func(m *Message) {
+		m.set(optCursor, cursor)
+	}
+}
+
+//===========================================================================
+// Ordered scans of the store
+//===========================================================================
+
+// Returns up to limit entries in key order that have the prefix, are in the
+// range from start to end and come after the cursor, skipping tombstones.
+// The cursor is the last key returned if there are more entries to scan.
+func (r *Replica) scan(prefix, start, end, cursor string, limit int) ([]*Message, string, error) {
+	lower := prefix
+	if start > lower {
+		lower = start
+	}
+	if cursor != "" && cursor >= lower {
+		lower = cursor + "\x00"
+	}
+
+	var next string
+	entries := make([]*Message, 0)
+	err := r.store.Iterate(lower, func(val *Message) bool {
+		if !strings.HasPrefix(val.key, prefix) || (end != "" && val.key >= end) {
+			return false
+		}
+
+		if val.method == MethodDelete {
+			return true
+		}
+
+		// There is another entry, so the client must fetch the next page
+		if len(entries) == limit {
+			next = entries[len(entries)-1].key
+			return false
+		}
+		entries = append(entries, val)
+		return true
+	})
+
+	return entries, next, err
+}
+
+//===========================================================================
+// Replica scan handler
+//===========================================================================
+
+// Handle a Scan request from a client, replying with a page of the keys in
+// the range encoded in the body and the cursor of the next page (if any) in
+// the options. The sequence of the reply is the state the scan was served at.
+func (r *Replica) onScan(msg *Message, route [][]byte) error {
+	prefix := msg.options.Get(optPrefix)
+	if !r.holdsRange(prefix, msg.options.Get(optStart), msg.options.Get(optEnd)) {
+		return r.sendError(r.requests, route, prefix, ErrNotReplicated)
+	}
+
+	limit := DefaultScanLimit
+	if val := msg.options.Get(optLimit); val != "" {
+		var err error
+		if limit, err = strconv.Atoi(val); err != nil || limit < 1 {
+			return r.sendError(r.requests, route, prefix, protocolErrorf("bad scan limit %q", val))
+		}
+	}
+
+	entries, cursor, err := r.scan(prefix, msg.options.Get(optStart), msg.options.Get(optEnd), msg.options.Get(optCursor), limit)
+	if err != nil {
+		return r.sendError(r.requests, route, prefix, err)
+	}
+
+	buf := new(bytes.Buffer)
+	for _, entry := range entries {
+		if err := entry.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	rep := &Message{
+		method:   MethodScan,
+		sequence: r.sequence,
+		term:     r.term,
+		key:      prefix,
+		body:     buf.Bytes(),
+	}
+	if cursor != "" {
+		rep.set(optCursor, cursor)
+	}
+
+	debug("scanned %d keys with prefix %q", len(entries), prefix)
+	return r.respond(rep, route)
+}
+
+// Decode the key/values and the cursor of the next page in a scan reply.
+func decodeScan(rep *Message) ([]*KeyValue, string, error) {
+	kvs := make([]*KeyValue, 0)
+	buf := bytes.NewReader(rep.body)
+	for {
+		entry, err := ReadMessage(buf)
+		if err == io.EOF {
+			return kvs, rep.options.Get(optCursor), nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		kvs = append(kvs, &KeyValue{Key: entry.key, Value: entry.body, Version: Version(entry.sequence)})
+	}
+}
+
+//===========================================================================
+// Client scan requests
+//===========================================================================
+
+// Scan the keys of the replica in lexical order, bounded by the WithPrefix
+// and WithRange options. Returns a page of up to WithLimit keys and, if there
+// are more keys in the range, a cursor to pass to WithCursor to fetch the
+// next page; the cursor is empty on the last page.
+func (c *Client) Scan(ctx context.Context, opts ...Option) ([]*KeyValue, string, error) {
+	msg := &Message{
+		method:   MethodScan,
+		sequence: 0,
+		key:      "",
+		body:     nil,
+	}
+
+	rep, err := c.request(ctx, msg.apply(opts))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return decodeScan(rep)
+}
+
+// Scan the keys of the next replica in lexical order, failing over to the
+// other replicas if it does not respond. See Client.Scan for details.
+func (c *Cluster) Scan(ctx context.Context, opts ...Option) ([]*KeyValue, string, error) {
+	msg := &Message{
+		method:   MethodScan,
+		sequence: 0,
+		key:      "",
+		body:     nil,
+	}
+
+	start := c.next
+	c.next = (c.next + 1) % len(c.clients)
+
+	rep, err := c.request(ctx, msg.apply(opts), start)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return decodeScan(rep)
+}
@@ -0,0 +1,56 @@
+package dolly
+
+import (
+	"testing"
+)
+
+func TestScanEmptyKey(t *testing.T) {
+	r := &Replica{store: newMemoryStore()}
+	for i, key := range []string{"", "a", "b"} {
+		if err := r.store.Put(&Message{method: MethodPut, sequence: uint64(i + 1), key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, cursor, err := r.scan("", "", "", "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].key != "" || entries[1].key != "a" || cursor != "a" {
+		t.Fatalf("expected keys \"\" and \"a\" with cursor \"a\", got %d entries and cursor %q", len(entries), cursor)
+	}
+
+	if entries, cursor, err = r.scan("", "", "", cursor, 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].key != "b" || cursor != "" {
+		t.Errorf("expected key \"b\" without a cursor, got %d entries and cursor %q", len(entries), cursor)
+	}
+}
+
+func TestHoldsRange(t *testing.T) {
+	r := &Replica{Subtrees: []string{"users/", "\xff"}}
+
+	tests := []struct {
+		prefix, start, end string
+		held               bool
+	}{
+		{"users/", "", "", true},
+		{"users/alice", "", "", true},
+		{"", "users/", "users0", true},
+		{"", "users/a", "users/b", true},
+		{"", "users/", "", false},
+		{"", "users", "users/b", false},
+		{"", "users/a", "v", false},
+		{"", "", "", false},
+		{"user", "users/", "users/z", true},
+		{"orders/", "", "", false},
+		{"", "\xff", "", true},
+	}
+
+	for _, tt := range tests {
+		if held := r.holdsRange(tt.prefix, tt.start, tt.end); held != tt.held {
+			t.Errorf("expected range %q [%q, %q) held=%t, got %t", tt.prefix, tt.start, tt.end, tt.held, held)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// This file implements the optional CURVE encryption and authentication of
+// the sockets between replicas and clients. A replica that is configured with
+// a keypair serves its sockets as a CURVE server and runs a ZAP handler that
+// only accepts the public keys of its peers and of the clients it allows.
+
+package dolly
+
+import (
+	"errors"
+	"fmt"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// ZAP (ZMQ RFC 27) constants for the authentication handler.
+const (
+	zapEndpoint = "inproc://zeromq.zap.01"
+	zapVersion  = "1.0"
+	zapDomain   = "dolly"
+	zapUserID   = "User-Id"
+)
+
+// Returned by clients that connect to a replica with a keypair without one.
+var errNoKeypair = errors.New("a CURVE keypair is required to connect to the replica")
+
+// Returns true if the replica is configured with a CURVE keypair.
+func (r *Replica) secure() bool {
+	return r.PublicKey != ""
+}
+
+// Serve a socket bound by the replica as a CURVE server if the replica is
+// configured with a keypair.
+func (r *Replica) serveCurve(sock *zmq.Socket) error {
+	if !r.secure() {
+		return nil
+	}
+	return sock.ServerAuthCurve(zapDomain, r.SecretKey)
+}
+
+// Connect a socket to a peer as a CURVE client if the peer is configured with
+// a keypair, which requires the replica to have a keypair as well.
+func (r *Replica) connectCurve(sock *zmq.Socket, peer *Replica) error {
+	if !peer.secure() {
+		return nil
+	}
+	if !r.secure() {
+		return fmt.Errorf("replica %s requires a keypair to connect to %s", r.Name, peer.Name)
+	}
+	return sock.ClientAuthCurve(peer.PublicKey, r.PublicKey, r.SecretKey)
+}
+
+// Check that the secret key of the replica matches its public key.
+func (r *Replica) checkKeypair() error {
+	if !r.secure() {
+		return nil
+	}
+
+	public, err := zmq.AuthCurvePublic(r.SecretKey)
+	if err != nil {
+		return fmt.Errorf("bad secret key for replica %s: %s", r.Name, err)
+	}
+	if public != r.PublicKey {
+		return fmt.Errorf("secret key of replica %s does not match its public key", r.Name)
+	}
+	return nil
+}
+
+// Connect a client socket to the replica as a CURVE client if the replica is
+// configured with a keypair.
+func (c *Client) curve(sock *zmq.Socket) error {
+	if !c.replica.secure() {
+		return nil
+	}
+	if c.public == "" {
+		return errNoKeypair
+	}
+	return sock.ClientAuthCurve(c.replica.PublicKey, c.public, c.secret)
+}
+
+// Receive a routed request off a socket served by the replica, along with the
+// ZAP user id of the sender, which is the public key of its CURVE connection.
+// The user id is empty unless the replica authenticates its connections.
+func (r *Replica) recvRequest(sock *zmq.Socket) (*Message, [][]byte, string, error) {
+	if !r.secure() {
+		msg, route, err := RecvMessage(sock, true)
+		return msg, route, "", err
+	}
+
+	parts, metadata, err := sock.RecvMessageBytesWithMetadata(0, zapUserID)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	msg, route, err := splitMessage(parts, true)
+	return msg, route, metadata[zapUserID], err
+}
+
+// Returns true if the election message was sent by the peer it names, so that
+// a client with an allowed key cannot depose the leader. Election messages are
+// received on the requests socket that clients also connect to, and a sender
+// can only be identified by its CURVE key: without a keypair, any client that
+// can reach the requests socket can take part in elections.
+func (r *Replica) fromPeer(msg *Message, user string) bool {
+	if !r.secure() {
+		return true
+	}
+
+	peer, err := r.network.peers.Get(msg.key)
+	if err == nil && peer != r && peer.secure() && peer.PublicKey == user {
+		return true
+	}
+
+	warn("dropped %s from %q sent with key %s", msg.method, msg.key, user)
+	return false
+}
+
+//===========================================================================
+// ZAP authentication handler
+//===========================================================================
+
+// authenticator handles the ZAP requests of the CURVE server sockets in the
+// context of the network, accepting only the allowed public keys.
+type authenticator struct {
+	sock    *zmq.Socket     // the REP socket bound to the ZAP endpoint
+	allowed map[string]bool // the allowed public keys (Z85 encoded)
+}
+
+// Start the ZAP handler if the local replica is configured with a keypair,
+// allowing the public keys of every peer and the clients of the local replica.
+// The handler must be bound before any CURVE server sockets are bound.
+func (n *Network) authenticate() (err error) {
+	if !n.local.secure() {
+		return nil
+	}
+
+	if err = n.local.checkKeypair(); err != nil {
+		return err
+	}
+
+	auth := &authenticator{allowed: make(map[string]bool)}
+	for _, peer := range n.peers {
+		if peer.secure() {
+			auth.allowed[peer.PublicKey] = true
+		}
+	}
+	for _, key := range n.local.Clients {
+		auth.allowed[key] = true
+	}
+
+	if auth.sock, err = n.context.NewSocket(zmq.REP); err != nil {
+		return err
+	}
+	if err = auth.sock.SetLinger(0); err != nil {
+		return err
+	}
+	if err = auth.sock.Bind(zapEndpoint); err != nil {
+		return err
+	}
+
+	info("authenticating CURVE connections from %d allowed keys", len(auth.allowed))
+	go auth.run()
+	return nil
+}
+
+// Reply to ZAP requests until the context is terminated.
+func (a *authenticator) run() {
+	defer a.sock.Close()
+	for {
+		req, err := a.sock.RecvMessageBytes(0)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.ETERM {
+				return
+			}
+			warne(err)
+			continue
+		}
+
+		if _, err = a.sock.SendMessage(a.handle(req)); err != nil {
+			warne(err)
+		}
+	}
+}
+
+// Handle a ZAP request, which has the frames version, request id, domain,
+// address, identity, mechanism and credentials, returning the frames of the
+// reply: version, request id, status code, status text, user id and metadata.
+func (a *authenticator) handle(req [][]byte) []string {
+	if len(req) < 6 || string(req[0]) != zapVersion {
+		warn("malformed ZAP request with %d frames", len(req))
+		return []string{zapVersion, "", "400", "malformed request", "", ""}
+	}
+
+	id, address, mechanism := string(req[1]), string(req[3]), string(req[5])
+	if mechanism != "CURVE" || len(req) != 7 || len(req[6]) != 32 {
+		warn("rejected %s connection from %s", mechanism, address)
+		return []string{zapVersion, id, "400", "CURVE required", "", ""}
+	}
+
+	key := zmq.Z85encode(string(req[6]))
+	if !a.allowed[key] {
+		warn("rejected CURVE connection from %s with key %s", address, key)
+		return []string{zapVersion, id, "400", "key not allowed", "", ""}
+	}
+
+	trace("accepted CURVE connection from %s with key %s", address, key)
+	return []string{zapVersion, id, "200", "OK", key, ""}
+}
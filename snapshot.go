@@ -0,0 +1,654 @@
+// This file implements the transfer of snapshots of the store from the leader
+// to a replica in chunks, with flow control so the leader never sends more
+// chunks than the replica has asked for (the FileMQ credit model).
+
+package dolly
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"strconv"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Snapshot transfer constants. The replica grants the leader credit to send
+// a number of chunks, then requests more as they are received. If a chunk does
+// not arrive within the snapshot timeout, the transfer is resumed from the
+// last chunk received, up to the number of retries.
+const (
+	SnapshotChunkSize = 256
+	SnapshotCredit    = 4
+	SnapshotTimeout   = ElectionTimeout
+	SnapshotRetries   = 3
+)
+
+// How long a transfer is kept by the leader after the last request for its
+// chunks, so that the replica can resume it after each of its retries.
+const transferTimeout = (SnapshotRetries + 1) * SnapshotTimeout
+
+// Names of the options of snapshot requests and chunks.
+const (
+	optOffset   = "offset"
+	optCredit   = "credit"
+	optChecksum = "checksum"
+	optDelta    = "delta"
+)
+
+//===========================================================================
+// Replica snapshot transfer
+//===========================================================================
+
+// Snapshot starts fetching the store from the leader in chunks to become up
+// to date, replacing the local state once every chunk has been received. If
+// the leader still has every update after the state of the replica in its
+// log, only those updates are sent and applied to the local state instead.
+// The chunks are received by the event loop of the replica, which keeps
+// serving requests and buffers the updates published until the transfer is
+// complete. If the leader stops sending chunks, the transfer is resumed up to
+// SnapshotRetries times and then abandoned, leaving the state unchanged.
+func (r *Replica) Snapshot() error {
+	if r.download != nil {
+		return nil
+	}
+
+	r.download = &download{id: strconv.FormatUint(rand.Uint64(), 16)}
+	return r.request(r.download)
+}
+
+// Handle a chunk, the end, or the failure of the snapshot being fetched. If
+// the leader lost the transfer it is started again from the beginning, and if
+// the leader is behind the replica, a leader with the latest state is elected.
+func (r *Replica) onTransfer(msg *Message) error {
+	t := r.download
+	switch msg.method {
+	case MethodChunk:
+		return r.receive(t, msg)
+	case MethodTerm:
+		r.download = nil
+		defer t.discard()
+		return r.install(t, msg)
+	}
+
+	r.abandon()
+	if string(msg.body) == errLeaderBehind.Error() {
+		warn("leader is behind local state %d", r.sequence)
+		return r.elect()
+	}
+
+	warn("snapshot transfer failed: %s", msg.body)
+	if t.retries >= SnapshotRetries {
+		warn("could not fetch snapshot from the leader: %s", ErrTimeout)
+		return r.resume()
+	}
+
+	r.download = &download{id: strconv.FormatUint(rand.Uint64(), 16), retries: t.retries + 1}
+	return r.request(r.download)
+}
+
+// Resume the snapshot being fetched from the next chunk if the leader has not
+// sent one within the snapshot timeout, abandoning it after SnapshotRetries.
+func (r *Replica) retransfer() error {
+	t := r.download
+	if t == nil || time.Now().Before(t.deadline) {
+		return nil
+	}
+
+	t.retries++
+	if t.retries > SnapshotRetries {
+		warn("could not fetch snapshot from the leader: %s", ErrTimeout)
+		r.abandon()
+		return r.resume()
+	}
+
+	warn("no snapshot chunk in %s, resuming from chunk %d", SnapshotTimeout, t.next)
+	return r.request(t)
+}
+
+// Abandon the snapshot being fetched, if any, discarding what was received.
+func (r *Replica) abandon() {
+	if r.download != nil {
+		r.download.discard()
+		r.download = nil
+	}
+}
+
+// Apply the updates buffered while a snapshot was fetched that follow the state
+// of the replica, and request the range of any that are still missing.
+func (r *Replica) resume() error {
+	for seq := range r.pending {
+		if seq <= r.sequence {
+			delete(r.pending, seq)
+		}
+	}
+
+	if next, ok := r.pending[r.sequence+1]; ok {
+		delete(r.pending, next.sequence)
+		if err := r.apply(next); err != nil {
+			return err
+		}
+	}
+
+	for seq := range r.pending {
+		return r.catchup(seq)
+	}
+	return nil
+}
+
+// download is the state of a snapshot transfer on the replica. The entries of
+// a full snapshot are written to a staging store as they are received, and the
+// updates of a delta transfer (at most the log size) are kept in memory.
+type download struct {
+	id       string     // identifies the transfer to the leader
+	next     int        // index of the next chunk to receive
+	received int        // chunks received since credit was last granted
+	retries  int        // times the transfer was resumed without progress
+	deadline time.Time  // when the transfer is resumed if no chunk arrives
+	entries  []*Message // the updates received if a delta
+	stage    Store      // the store the entries are received into if not a delta
+}
+
+// Discard the staging store of the transfer if it was not installed.
+func (t *download) discard() {
+	if t.stage != nil {
+		discardStaging(t.stage)
+		t.stage = nil
+	}
+}
+
+// Request chunks from the next chunk of the transfer, granting credit.
+func (r *Replica) request(t *download) error {
+	req := r.mark(&Message{
+		method:   MethodSnapshot,
+		sequence: r.sequence,
+		key:      t.id,
+		body:     nil,
+	})
+	req.set(optOffset, strconv.Itoa(t.next))
+	req.set(optCredit, strconv.Itoa(SnapshotCredit))
+
+	t.received = 0
+	t.deadline = time.Now().Add(SnapshotTimeout)
+	return r.filter(req).Send(r.snapshots, nil)
+}
+
+// Receive a chunk, verifying its checksum, and grant more credit if the
+// chunks requested have all been received.
+func (r *Replica) receive(t *download, chunk *Message) error {
+	// Drop chunks resent after a resumption that were already received
+	if offset, _ := strconv.Atoi(chunk.options.Get(optOffset)); offset != t.next {
+		return nil
+	}
+
+	if chunk.options.Get(optChecksum) != checksum(chunk.body) {
+		warn("bad checksum on snapshot chunk %d, resuming", t.next)
+		return r.request(t)
+	}
+
+	entries := make([]*Message, 0, SnapshotChunkSize)
+	buf := bytes.NewReader(chunk.body)
+	for {
+		entry, err := ReadMessage(buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			warn("could not decode snapshot chunk %d: %s, resuming", t.next, err)
+			return r.request(t)
+		}
+		entries = append(entries, entry)
+	}
+
+	if chunk.options.Get(optDelta) != "" {
+		t.entries = append(t.entries, entries...)
+	} else {
+		if t.stage == nil {
+			var err error
+			if t.stage, err = r.openStaging(); err != nil {
+				return err
+			}
+		}
+		for _, entry := range entries {
+			if err := t.stage.Put(entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	t.next++
+	t.received++
+	t.retries = 0
+	t.deadline = time.Now().Add(SnapshotTimeout)
+
+	if t.received == SnapshotCredit {
+		return r.request(t)
+	}
+	return nil
+}
+
+// Replace the local state with the entries of a completed transfer, or apply
+// the updates of a transfer of the deltas since the state of the replica. The
+// deltas are persisted as they are applied like updates from the leader, and
+// the store received in a full transfer is compacted into the data directory
+// before the new state is acknowledged, so neither is lost in a crash.
+func (r *Replica) install(t *download, term *Message) error {
+	delta := term.options.Get(optDelta) != ""
+	if delta {
+		for _, update := range t.entries {
+			if update.sequence <= r.sequence {
+				continue
+			}
+			if err := r.commit(update); err != nil {
+				return err
+			}
+		}
+		info("received %d updates and up to date with state %d", len(t.entries), term.sequence)
+	} else {
+		// An empty store is sent without any chunks
+		if t.stage == nil {
+			var err error
+			if t.stage, err = r.openStaging(); err != nil {
+				return err
+			}
+		}
+
+		keys := t.stage.Len()
+		if err := r.installStaging(t.stage); err != nil {
+			return err
+		}
+		t.stage = nil
+		r.deleted = nil
+		info("received %d keys in %d chunks and up to date with snapshot %d", keys, t.next, term.sequence)
+	}
+
+	r.catching = false
+	r.sequence = term.sequence
+	r.term = term.term
+	r.lastTerm = positionOf(term).term
+
+	if !delta {
+		if err := r.compact(); err != nil {
+			return err
+		}
+	}
+	if err := r.release(); err != nil {
+		return err
+	}
+	return r.resume()
+}
+
+// Returns the checksum of the body of a chunk.
+func checksum(body []byte) string {
+	return strconv.FormatUint(uint64(crc32.ChecksumIEEE(body)), 16)
+}
+
+//===========================================================================
+// Frozen views of the store
+//===========================================================================
+
+// view is the store frozen at a known state that snapshots are streamed from
+// by another goroutine. The view is a snapshot of the store, which the storage
+// engine never modifies while it is being read.
+type view struct {
+	store    Store  // the snapshot of the store
+	sequence uint64 // the state of the store when it was frozen
+	term     uint64 // the term of the leader when it was frozen
+	lastTerm uint64 // the term of the leader that sequenced the state
+}
+
+// Freeze the store into a view.
+func (r *Replica) freeze() *view {
+	return &view{store: r.store.Snapshot(), sequence: r.sequence, term: r.term, lastTerm: r.lastTerm}
+}
+
+// Close the snapshot of the view, if it has one, once no transfer is reading
+// from it, so that the on-disk engine can close the files it read from.
+func (v *view) close() {
+	if v.store != nil {
+		v.store.Close()
+		v.store = nil
+	}
+}
+
+//===========================================================================
+// Leader snapshot transfer
+//===========================================================================
+
+// Hand a request for the chunks of a snapshot to the snapshotter, freezing the
+// store if it begins a transfer. The store is only frozen once the snapshotter
+// has room for the request and the transfer is not already running, so that
+// it is not copied on every request for more chunks. If the log holds every
+// update after the state of the replica, and the replica's latest update is
+// the one in the log at its state, only those updates are sent. A leader that
+// is behind the replica refuses so that it never replaces newer state with
+// its own.
+func (l *Leader) onSnapshot(msg *Message, route [][]byte) error {
+	if positionOf(msg).after(l.latest()) {
+		return l.sendError(l.snapshots, route, msg.key, errLeaderBehind)
+	}
+
+	// Drop the request if the snapshotter is backed up; the replica resumes.
+	// The leader is the only sender, so the request fits if there is room.
+	if len(l.snapshotter.requests) == cap(l.snapshotter.requests) {
+		debug("snapshotter is busy, dropping request for transfer %s", msg.key)
+		return nil
+	}
+
+	now := time.Now()
+	for id, expires := range l.transfers {
+		if now.After(expires) {
+			delete(l.transfers, id)
+		}
+	}
+
+	req := &snapshotRequest{msg: msg, route: route}
+	if _, running := l.transfers[msg.key]; !running && msg.options.Get(optOffset) == "0" {
+		if msg.sequence > 0 && msg.sequence <= l.sequence && l.follows(positionOf(msg)) {
+			req.view = &view{sequence: l.sequence, term: l.term, lastTerm: l.lastTerm}
+			req.deltas = l.since(msg.sequence)
+		} else {
+			req.view = l.freeze()
+		}
+	}
+
+	if _, running := l.transfers[msg.key]; running || req.view != nil {
+		l.transfers[msg.key] = now.Add(transferTimeout)
+	}
+	l.snapshotter.requests <- req
+	return nil
+}
+
+// Relay a chunk from the snapshotter to the replica it is addressed to.
+func (l *Leader) onRelay() error {
+	parts, err := l.relay.RecvMessageBytes(0)
+	if err != nil {
+		return err
+	}
+
+	if _, err = l.snapshots.SendMessageDontwait(parts); err != nil {
+		debug("could not relay snapshot chunk: %s", err)
+	}
+	return nil
+}
+
+// Start the snapshotter in its own goroutine, connected to the leader by an
+// inproc socket that it sends the chunks of snapshots on.
+func (l *Leader) startSnapshotter() (err error) {
+	endpoint := fmt.Sprintf("inproc://%s-snapshots", l.Name)
+	if l.relay, err = l.context.NewSocket(zmq.PAIR); err != nil {
+		return err
+	}
+	if err = l.relay.Bind(endpoint); err != nil {
+		return err
+	}
+
+	l.snapshotter = &snapshotter{
+		requests:  make(chan *snapshotRequest, 64),
+		transfers: make(map[string]*transfer),
+		metrics:   l.metrics,
+	}
+	if l.snapshotter.relay, err = l.context.NewSocket(zmq.PAIR); err != nil {
+		return err
+	}
+	if err = l.snapshotter.relay.Connect(endpoint); err != nil {
+		return err
+	}
+
+	go l.snapshotter.run()
+	return nil
+}
+
+// Disconnect stops the snapshotter and closes the sockets of the leader.
+func (l *Leader) Disconnect() error {
+	if l.snapshotter != nil {
+		close(l.snapshotter.requests)
+		l.snapshotter = nil
+	}
+
+	if l.relay != nil {
+		if err := l.relay.Close(); err != nil {
+			return err
+		}
+		l.relay = nil
+	}
+
+	return l.Replica.Disconnect()
+}
+
+// Returns a copy of the updates in the log after the sequence.
+func (l *Leader) since(sequence uint64) []*Message {
+	deltas := make([]*Message, 0)
+	for _, entry := range l.log {
+		if entry.sequence > sequence {
+			deltas = append(deltas, entry)
+		}
+	}
+	return deltas
+}
+
+// snapshotRequest is a request for the chunks of a snapshot along with the
+// route of the replica and, if it begins a transfer, the view of the store to
+// send. If the updates after the state of the replica are sent instead, the
+// view only records the state of the store.
+type snapshotRequest struct {
+	msg    *Message
+	route  [][]byte
+	view   *view
+	deltas []*Message
+}
+
+// snapshotter streams the chunks of snapshots from frozen views of the store
+// in its own goroutine so that the leader keeps sequencing writes. The chunks
+// are sent to the leader to relay to the replicas since sockets cannot be
+// shared between goroutines.
+type snapshotter struct {
+	requests  chan *snapshotRequest // requests handed off by the leader
+	transfers map[string]*transfer  // snapshots being sent to replicas by id
+	relay     *zmq.Socket           // socket to send chunks to the leader on
+	metrics   *metrics              // the metrics of the leader
+}
+
+// transfer is a snapshot being sent to a replica in chunks. The keys of the
+// entries are kept rather than the entries, which are read from the view as
+// each chunk is sent so that the store does not have to fit in memory.
+type transfer struct {
+	view    *view      // the frozen store the snapshot is taken from
+	keys    []string   // the keys in the subtrees of the replica
+	entries []*Message // the updates in the subtrees of the replica if a delta
+	delta   bool       // if the updates after the state of the replica are sent
+	expires time.Time  // when the transfer is abandoned if not requested
+}
+
+// Serve the requests handed off by the leader until it steps down, then close
+// the views of the transfers that have not expired.
+func (s *snapshotter) run() {
+	defer s.relay.Close()
+	defer func() {
+		for _, t := range s.transfers {
+			t.view.close()
+		}
+	}()
+
+	ticker := time.NewTicker(SnapshotTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case req, ok := <-s.requests:
+			if !ok {
+				return
+			}
+			s.serve(req)
+		case <-ticker.C:
+			s.expire()
+		}
+	}
+}
+
+// Send the chunks of a snapshot that a replica has granted credit for,
+// starting the transfer with the entries (or updates) in the subtrees that
+// the replica requested if this is its first request. The end of the
+// transfer is marked with the sequence of the view.
+func (s *snapshotter) serve(req *snapshotRequest) {
+	msg := req.msg
+	offset, err := strconv.Atoi(msg.options.Get(optOffset))
+	if err != nil || offset < 0 {
+		s.fail(req, protocolErrorf("bad snapshot offset %q", msg.options.Get(optOffset)))
+		return
+	}
+
+	credit, err := strconv.Atoi(msg.options.Get(optCredit))
+	if err != nil || credit < 1 {
+		s.fail(req, protocolErrorf("bad snapshot credit %q", msg.options.Get(optCredit)))
+		return
+	}
+
+	// A transfer that the leader expired just before the snapshotter did is
+	// still running, so the view frozen for it is not needed
+	t, ok := s.transfers[msg.key]
+	if ok && req.view != nil {
+		req.view.close()
+	}
+	if !ok {
+		if req.view == nil {
+			s.fail(req, fmt.Errorf("snapshot transfer %s not found", msg.key))
+			return
+		}
+
+		t = &transfer{view: req.view, delta: req.deltas != nil}
+		subtrees := msg.options[optSubtree]
+		if t.delta {
+			for _, update := range req.deltas {
+				if matches(update, subtrees) {
+					t.entries = append(t.entries, update)
+				}
+			}
+		} else if err := t.view.store.Iterate("", func(val *Message) bool {
+			if matches(val, subtrees) {
+				t.keys = append(t.keys, val.key)
+			}
+			return true
+		}); err != nil {
+			t.view.close()
+			s.fail(req, err)
+			return
+		}
+
+		s.transfers[msg.key] = t
+		s.metrics.snapshot(t.size())
+		info("started snapshot transfer of %d entries at state %d", t.size(), t.view.sequence)
+	}
+	t.expires = time.Now().Add(transferTimeout)
+
+	// Send the chunks the replica has credit for
+	chunks := (t.size() + SnapshotChunkSize - 1) / SnapshotChunkSize
+	for i := offset; i < offset+credit && i < chunks; i++ {
+		chunk, err := t.chunk(i, msg.key)
+		if err != nil {
+			s.fail(req, err)
+			return
+		}
+
+		if err := chunk.Send(s.relay, req.route); err != nil {
+			debug("could not send snapshot chunk %d: %s", i, err)
+			return
+		}
+	}
+
+	// Send finished with sequence number once the last chunk is sent; the
+	// transfer is kept until it expires in case the replica must resume it
+	if offset+credit >= chunks {
+		reply := &Message{
+			method:   MethodTerm,
+			sequence: t.view.sequence,
+			term:     t.view.term,
+			key:      msg.key,
+			body:     nil,
+		}
+		reply.set(optLastTerm, strconv.FormatUint(t.view.lastTerm, 10))
+		if t.delta {
+			reply.set(optDelta, "true")
+		}
+		reply.Send(s.relay, req.route)
+		info("sent %d entries on state snapshot %d", t.size(), t.view.sequence)
+	}
+}
+
+// Reply to a request for a snapshot with an error.
+func (s *snapshotter) fail(req *snapshotRequest, err error) {
+	rep := &Message{
+		method:   MethodError,
+		sequence: 0,
+		key:      req.msg.key,
+		body:     []byte(err.Error()),
+	}
+	rep.Send(s.relay, req.route)
+}
+
+// Abandon the transfers that replicas have stopped requesting chunks of,
+// including those that have sent every chunk, closing their views.
+func (s *snapshotter) expire() {
+	for id, t := range s.transfers {
+		if time.Now().After(t.expires) {
+			debug("snapshot transfer %s expired", id)
+			t.view.close()
+			delete(s.transfers, id)
+		}
+	}
+}
+
+// Create the chunk of the transfer at the index, with the checksum of its body.
+func (t *transfer) chunk(index int, id string) (*Message, error) {
+	end := (index + 1) * SnapshotChunkSize
+	if end > t.size() {
+		end = t.size()
+	}
+
+	buf := new(bytes.Buffer)
+	for i := index * SnapshotChunkSize; i < end; i++ {
+		entry, err := t.entry(i)
+		if err != nil {
+			return nil, err
+		}
+		entry.Write(buf)
+	}
+
+	chunk := &Message{
+		method:   MethodChunk,
+		sequence: t.view.sequence,
+		term:     t.view.term,
+		key:      id,
+		body:     buf.Bytes(),
+	}
+	chunk.set(optOffset, strconv.Itoa(index))
+	chunk.set(optChecksum, checksum(chunk.body))
+	if t.delta {
+		chunk.set(optDelta, "true")
+	}
+	return chunk, nil
+}
+
+// Returns the number of entries (or updates) sent in the transfer.
+func (t *transfer) size() int {
+	if t.delta {
+		return len(t.entries)
+	}
+	return len(t.keys)
+}
+
+// Returns the entry (or update) of the transfer at the index.
+func (t *transfer) entry(i int) (*Message, error) {
+	if t.delta {
+		return t.entries[i], nil
+	}
+
+	entry, ok := t.view.store.Get(t.keys[i])
+	if !ok {
+		return nil, fmt.Errorf("could not read key %q from snapshot", t.keys[i])
+	}
+	return entry, nil
+}
@@ -0,0 +1,73 @@
+package dolly
+
+import (
+	"testing"
+	"time"
+)
+
+// Create a leader with a memory store and a snapshotter that is not running,
+// so that the requests handed off to it queue in its channel.
+func makeSnapshotLeader(queue int) (*Leader, *memoryStore) {
+	store := newMemoryStore()
+	l := &Leader{
+		Replica:     &Replica{Name: "alpha", store: store},
+		snapshotter: &snapshotter{requests: make(chan *snapshotRequest, queue)},
+		transfers:   make(map[string]time.Time),
+	}
+	return l, store
+}
+
+// Request the first chunks of the transfer from the leader.
+func requestSnapshot(t *testing.T, l *Leader, id string) {
+	msg := &Message{method: MethodSnapshot, key: id}
+	msg.set(optOffset, "0")
+	msg.set(optCredit, "1")
+	if err := l.onSnapshot(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSnapshotFreezesOnce(t *testing.T) {
+	l, _ := makeSnapshotLeader(4)
+
+	// A transfer is frozen when it starts but not when it is resumed
+	requestSnapshot(t, l, "a")
+	requestSnapshot(t, l, "a")
+	requestSnapshot(t, l, "b")
+
+	views := 0
+	for len(l.snapshotter.requests) > 0 {
+		if req := <-l.snapshotter.requests; req.view != nil {
+			views++
+		}
+	}
+	if views != 2 {
+		t.Errorf("expected a view for each of 2 transfers, got %d", views)
+	}
+
+	// An expired transfer is frozen again when it is restarted
+	l.transfers["a"] = time.Now().Add(-time.Second)
+	requestSnapshot(t, l, "a")
+	if req := <-l.snapshotter.requests; req.view == nil {
+		t.Error("expected a view for the restarted transfer")
+	}
+}
+
+func TestSnapshotDroppedWithoutFreezing(t *testing.T) {
+	l, store := makeSnapshotLeader(1)
+
+	requestSnapshot(t, l, "a")
+	store.shared = false
+
+	// The snapshotter is backed up, so the request is dropped unfrozen
+	requestSnapshot(t, l, "b")
+	if store.shared {
+		t.Error("expected the store not to be frozen for a dropped request")
+	}
+	if _, ok := l.transfers["b"]; ok {
+		t.Error("expected the dropped transfer not to be tracked")
+	}
+	if len(l.snapshotter.requests) != 1 {
+		t.Errorf("expected 1 queued request, got %d", len(l.snapshotter.requests))
+	}
+}
@@ -0,0 +1,168 @@
+// This file implements the status request that reports what a replica thinks
+// is going on, so that the state of the cluster can be inspected.
+
+package dolly
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Roles of a replica reported in its status.
+const (
+	RoleLeader    = "leader"
+	RoleReplica   = "replica"
+	RoleCandidate = "candidate"
+)
+
+// Status describes a replica as reported by the replica itself.
+type Status struct {
+	Name     string        `json:"name"`     // the name of the replica
+	PID      uint16        `json:"pid"`      // the precedence id of the replica
+	Role     string        `json:"role"`     // leader, replica, or candidate if electing
+	Sequence uint64        `json:"sequence"` // the latest state applied by the replica
+	Term     uint64        `json:"term"`     // the election term of the current leader
+	Keys     int           `json:"keys"`     // the number of keys in the store
+	Leader   string        `json:"leader"`   // the name of the leader of the replica
+	Endpoint string        `json:"endpoint"` // the endpoint of the leader updates are received from
+	Uptime   time.Duration `json:"uptime"`   // how long the replica has been running
+	Err      error         `json:"-"`        // the error if the replica could not be reached
+}
+
+// Statuses is a table of the status of every replica in the cluster.
+type Statuses []*Status
+
+// String returns a table of the statuses with the lag of each replica behind
+// the leader (or the most up to date replica if no leader replied).
+func (s Statuses) String() string {
+	var latest uint64
+	for _, status := range s {
+		if status.Err != nil {
+			continue
+		}
+		if status.Role == RoleLeader {
+			latest = status.Sequence
+			break
+		}
+		if status.Sequence > latest {
+			latest = status.Sequence
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	w := tabwriter.NewWriter(buf, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "replica\tpid\trole\tstate\tlag\tkeys\tleader\tuptime")
+	for _, status := range s {
+		if status.Err != nil {
+			fmt.Fprintf(w, "%s\t%d\tunreachable\t-\t-\t-\t-\t%s\n", status.Name, status.PID, status.Err)
+			continue
+		}
+
+		var lag uint64
+		if status.Sequence < latest {
+			lag = latest - status.Sequence
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%d\t%s\t%s\n", status.Name, status.PID, status.Role, status.Sequence, lag, status.Keys, status.Leader, status.Uptime.Round(time.Second))
+	}
+	w.Flush()
+	return buf.String()
+}
+
+//===========================================================================
+// Replica status handler
+//===========================================================================
+
+// Handle a Status request from a client, replying with the status of the
+// replica encoded as JSON in the body.
+func (r *Replica) onStatus(msg *Message, route [][]byte) error {
+	status := &Status{
+		Name:     r.Name,
+		PID:      r.PID,
+		Role:     RoleReplica,
+		Sequence: r.sequence,
+		Term:     r.term,
+		Keys:     r.store.Len(),
+	}
+
+	switch {
+	case r.electing:
+		status.Role = RoleCandidate
+	case r.network.leader == r:
+		status.Role = RoleLeader
+	}
+
+	if leader := r.network.leader; leader != nil {
+		status.Leader = leader.Name
+		status.Endpoint = fmt.Sprintf("tcp://%s:%d", leader.Addr, leader.Updates)
+	}
+
+	if !r.started.IsZero() {
+		status.Uptime = time.Since(r.started)
+	}
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	rep := &Message{
+		method:   MethodStatus,
+		sequence: r.sequence,
+		term:     r.term,
+		key:      r.Name,
+		body:     body,
+	}
+	return r.respond(rep, route)
+}
+
+//===========================================================================
+// Client status requests
+//===========================================================================
+
+// Status returns the status of the replica as reported by the replica.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	msg := &Message{
+		method:   MethodStatus,
+		sequence: 0,
+		key:      "",
+		body:     nil,
+	}
+
+	rep, err := c.request(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	status := new(Status)
+	if err = json.Unmarshal(rep.body, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Status returns the status of every replica in PID order, querying them
+// concurrently so that unreachable replicas do not delay the others. Replicas
+// that do not reply are included with the error from the request.
+func (c *Cluster) Status(ctx context.Context) Statuses {
+	var wg sync.WaitGroup
+	statuses := make(Statuses, len(c.clients))
+	for i, client := range c.clients {
+		wg.Add(1)
+		go func(i int, client *Client) {
+			defer wg.Done()
+			status, err := client.Status(ctx)
+			if err != nil {
+				status = &Status{Name: client.replica.Name, PID: client.replica.PID, Err: err}
+			}
+			statuses[i] = status
+		}(i, client)
+	}
+
+	wg.Wait()
+	return statuses
+}
@@ -0,0 +1,321 @@
+// This file defines the storage engine interface behind the key/value store of
+// a replica and the default in-memory engine.
+
+package dolly
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Storage engines that can be selected with the engine of a replica.
+const (
+	EngineMemory = "memory"
+	EngineDisk   = "disk"
+)
+
+// Returned when a snapshot of a store is changed.
+var errReadOnly = errors.New("store snapshot is read only")
+
+// Store is a storage engine that holds the entries of the key/value store,
+// which are the latest update of each key (including tombstones of deletes).
+type Store interface {
+	// Get the entry of the key, returning false if the key is not stored.
+	Get(key string) (*Message, bool)
+
+	// Put the entry of its key, replacing the previous entry.
+	Put(msg *Message) error
+
+	// Delete the entry of the key from the store.
+	Delete(key string) error
+
+	// Iterate over the entries in key order from the start key until the
+	// function returns false.
+	Iterate(start string, fn func(*Message) bool) error
+
+	// Snapshot returns a read-only view of the store in its current state
+	// that can be read by another goroutine while the store is changed.
+	Snapshot() Store
+
+	// Sequence returns the latest state of the entries put in the store.
+	Sequence() uint64
+
+	// Len returns the number of entries in the store.
+	Len() int
+
+	// Bytes returns the size of the store in bytes.
+	Bytes() int64
+
+	// Reset the store to empty.
+	Reset() error
+
+	// Sync the store to disk if it is durable.
+	Sync() error
+
+	// Close the store or snapshot, releasing the files it reads from.
+	Close() error
+}
+
+// Open the storage engine configured for the replica.
+func (r *Replica) openStore() (Store, error) {
+	switch r.Engine {
+	case "", EngineMemory:
+		return newMemoryStore(), nil
+	case EngineDisk:
+		if r.Data == "" {
+			return nil, fmt.Errorf("the %s engine requires a data directory", EngineDisk)
+		}
+		return openDiskStore(filepath.Join(r.Data, diskStoreFile))
+	default:
+		return nil, fmt.Errorf("unknown storage engine %q", r.Engine)
+	}
+}
+
+// Returns true if the store persists itself rather than relying on the
+// snapshot file in the data directory.
+func (r *Replica) durable() bool {
+	return r.Engine == EngineDisk
+}
+
+// Name of the data file that the on-disk engine receives snapshots into.
+const stagingFile = "staging.dat"
+
+// Open an empty store of the configured engine to receive the entries of a
+// snapshot into, so that the on-disk engine does not hold them in memory. The
+// store only replaces the store of the replica once the snapshot is complete.
+func (r *Replica) openStaging() (Store, error) {
+	if !r.durable() {
+		return newMemoryStore(), nil
+	}
+
+	path := filepath.Join(r.Data, stagingFile)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// The entries are synced when the snapshot is installed
+	stage, err := openDiskStore(path)
+	if err != nil {
+		return nil, err
+	}
+	stage.nosync = true
+	return stage, nil
+}
+
+// Replace the store of the replica with a staging store that has received a
+// complete snapshot. The data file of the on-disk engine is moved into place.
+func (r *Replica) installStaging(stage Store) error {
+	staged, ok := stage.(*diskStore)
+	if !ok {
+		r.store = stage
+		return nil
+	}
+
+	current := r.store.(*diskStore)
+	if err := staged.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(staged.path, current.path); err != nil {
+		return err
+	}
+
+	current.release()
+	staged.path = current.path
+	staged.nosync = false
+	r.store = staged
+	return nil
+}
+
+// Discard a staging store whose snapshot was abandoned.
+func discardStaging(stage Store) {
+	stage.Close()
+	if staged, ok := stage.(*diskStore); ok {
+		os.Remove(staged.path)
+	}
+}
+
+//===========================================================================
+// Sorted index of keys
+//===========================================================================
+
+// index is the keys of a store in sorted order so that they can be iterated.
+type index []string
+
+// Insert the key into the index if it is not already in it.
+func (idx index) insert(key string) index {
+	i := sort.SearchStrings(idx, key)
+	if i < len(idx) && idx[i] == key {
+		return idx
+	}
+
+	idx = append(idx, "")
+	copy(idx[i+1:], idx[i:])
+	idx[i] = key
+	return idx
+}
+
+// Remove the key from the index if it is in it.
+func (idx index) remove(key string) index {
+	i := sort.SearchStrings(idx, key)
+	if i == len(idx) || idx[i] != key {
+		return idx
+	}
+	return append(idx[:i], idx[i+1:]...)
+}
+
+// Sort the keys of the index in place.
+func (idx index) sort() {
+	sort.Strings(idx)
+}
+
+// Returns the position of the first key at or after the start key.
+func (idx index) seek(start string) int {
+	return sort.SearchStrings(idx, start)
+}
+
+//===========================================================================
+// In-memory store
+//===========================================================================
+
+// memoryStore holds the entries in a map alongside a sorted index of the keys.
+// Snapshots share the map and index with the store, which copies them before
+// it is next changed (copy on write) so that a snapshot is never modified.
+type memoryStore struct {
+	entries  map[string]*Message // the entries of the store by key
+	keys     index               // the keys of the entries in sorted order
+	sequence uint64              // the latest state of the entries put
+	bytes    int64               // the size of the keys and values of the entries
+	shared   bool                // if the entries are shared with a snapshot
+	frozen   bool                // if this is a read-only snapshot
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{entries: make(map[string]*Message)}
+}
+
+// Get implements Store.
+func (s *memoryStore) Get(key string) (*Message, bool) {
+	msg, ok := s.entries[key]
+	return msg, ok
+}
+
+// Put implements Store.
+func (s *memoryStore) Put(msg *Message) error {
+	if s.frozen {
+		return errReadOnly
+	}
+
+	s.own()
+	if old, ok := s.entries[msg.key]; ok {
+		s.bytes -= entrySize(old)
+	} else {
+		s.keys = s.keys.insert(msg.key)
+	}
+	s.entries[msg.key] = msg
+	s.bytes += entrySize(msg)
+
+	if msg.sequence > s.sequence {
+		s.sequence = msg.sequence
+	}
+	return nil
+}
+
+// Delete implements Store.
+func (s *memoryStore) Delete(key string) error {
+	if s.frozen {
+		return errReadOnly
+	}
+
+	old, ok := s.entries[key]
+	if !ok {
+		return nil
+	}
+
+	s.own()
+	s.bytes -= entrySize(old)
+	delete(s.entries, key)
+	s.keys = s.keys.remove(key)
+	return nil
+}
+
+// Iterate implements Store.
+func (s *memoryStore) Iterate(start string, fn func(*Message) bool) error {
+	for i := s.keys.seek(start); i < len(s.keys); i++ {
+		if !fn(s.entries[s.keys[i]]) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Snapshot implements Store.
+func (s *memoryStore) Snapshot() Store {
+	s.shared = true
+	return &memoryStore{entries: s.entries, keys: s.keys, sequence: s.sequence, bytes: s.bytes, frozen: true}
+}
+
+// Sequence implements Store.
+func (s *memoryStore) Sequence() uint64 {
+	return s.sequence
+}
+
+// Len implements Store.
+func (s *memoryStore) Len() int {
+	return len(s.entries)
+}
+
+// Bytes implements Store.
+func (s *memoryStore) Bytes() int64 {
+	return s.bytes
+}
+
+// Reset implements Store.
+func (s *memoryStore) Reset() error {
+	if s.frozen {
+		return errReadOnly
+	}
+
+	s.entries = make(map[string]*Message)
+	s.keys = nil
+	s.sequence = 0
+	s.bytes = 0
+	s.shared = false
+	return nil
+}
+
+// Sync implements Store, the in-memory store is not durable.
+func (s *memoryStore) Sync() error {
+	return nil
+}
+
+// Close implements Store, the in-memory store has no files to release.
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// Returns the size of the key and value of an entry.
+func entrySize(msg *Message) int64 {
+	return int64(len(msg.key) + len(msg.body))
+}
+
+// Copy the entries and index if they are shared with a snapshot.
+func (s *memoryStore) own() {
+	if !s.shared {
+		return
+	}
+
+	entries := make(map[string]*Message, len(s.entries))
+	for key, val := range s.entries {
+		entries[key] = val
+	}
+
+	keys := make(index, len(s.keys))
+	copy(keys, s.keys)
+
+	s.entries = entries
+	s.keys = keys
+	s.shared = false
+}
@@ -0,0 +1,113 @@
+// This file implements partial replicas that only hold the keys under the
+// prefixes (subtrees) in their configuration.
+
+package dolly
+
+import (
+	"strings"
+)
+
+// The topic of updates that every replica subscribes to, such as heartbeats
+// and transactions that can span subtrees. Keys that begin with the control
+// topic are still filtered out by replicas that do not hold them.
+const controlTopic = "\x00"
+
+// Returns the topic that the update is published on: its key if it changes a
+// single key, otherwise the control topic.
+func (m *Message) topic() [][]byte {
+	switch m.method {
+	case MethodPut, MethodDelete:
+		return [][]byte{[]byte(m.key)}
+	default:
+		return [][]byte{[]byte(controlTopic)}
+	}
+}
+
+// Returns true if the replica only holds the keys of its subtrees.
+func (r *Replica) partial() bool {
+	return len(r.Subtrees) > 0
+}
+
+// Returns true if the key is held by the replica.
+func (r *Replica) holds(key string) bool {
+	return inSubtrees(key, r.Subtrees)
+}
+
+// Returns true if every key with the prefix in the range from start to end is
+// held by the replica, either because the prefix is under one of its subtrees
+// or because the range only spans the keys of one.
+func (r *Replica) holdsRange(prefix, start, end string) bool {
+	if r.holds(prefix) {
+		return true
+	}
+
+	for _, subtree := range r.Subtrees {
+		if !strings.HasPrefix(subtree, prefix) || start < subtree {
+			continue
+		}
+
+		limit := prefixEnd(subtree)
+		if limit == "" || (end != "" && end <= limit) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first key after every key with the prefix, or an empty string
+// if there is none because the prefix is only 0xff bytes.
+func prefixEnd(prefix string) string {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1})
+		}
+	}
+	return ""
+}
+
+// Returns true if the key is under one of the subtrees or if there are none.
+func inSubtrees(key string, subtrees []string) bool {
+	if len(subtrees) == 0 {
+		return true
+	}
+
+	for _, prefix := range subtrees {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe to the updates of the subtrees of the replica, or to every update
+// if the replica holds the entire store.
+func (r *Replica) subscribe() error {
+	if !r.partial() {
+		return r.updates.SetSubscribe("")
+	}
+
+	if err := r.updates.SetSubscribe(controlTopic); err != nil {
+		return err
+	}
+	for _, prefix := range r.Subtrees {
+		if err := r.updates.SetSubscribe(prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add the subtrees of the replica to a snapshot or range request so that the
+// leader only sends the keys the replica holds.
+func (r *Replica) filter(req *Message) *Message {
+	for _, prefix := range r.Subtrees {
+		req.add(optSubtree, prefix)
+	}
+	return req
+}
+
+// Returns true if the update should be sent to a replica that requested the
+// subtrees. Transactions are always sent since the replica filters their ops.
+func matches(msg *Message, subtrees []string) bool {
+	return msg.method == MethodTxn || inSubtrees(msg.key, subtrees)
+}
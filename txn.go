@@ -0,0 +1,150 @@
+package dolly
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Txn is a batch of puts and deletes that the leader applies atomically in a
+// single state, optionally guarded by checks of the versions of keys.
+type Txn struct {
+	ops []*Message
+}
+
+// Put a value for the key when the transaction is applied.
+func (t *Txn) Put(key string, val []byte) *Txn {
+	t.ops = append(t.ops, &Message{method: MethodPut, key: key, body: val})
+	return t
+}
+
+// Delete the key when the transaction is applied.
+func (t *Txn) Delete(key string) *Txn {
+	t.ops = append(t.ops, &Message{method: MethodDelete, key: key})
+	return t
+}
+
+// Check that the key is at the expected version before the transaction is
+// applied; a version of zero requires that the key does not exist. If any
+// check fails, none of the operations in the transaction are applied.
+func (t *Txn) Check(key string, version Version) *Txn {
+	t.ops = append(t.ops, &Message{method: MethodCheck, sequence: uint64(version), key: key})
+	return t
+}
+
+// Create the transaction request to send to the leader.
+func (t *Txn) message() (*Message, error) {
+	buf := new(bytes.Buffer)
+	for _, op := range t.ops {
+		if err := op.Write(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	msg := &Message{
+		method:   MethodTxn,
+		sequence: 0,
+		key:      "",
+		body:     buf.Bytes(),
+	}
+	return msg, nil
+}
+
+// Decode the operations in the body of a transaction message.
+func decodeOps(body []byte) ([]*Message, error) {
+	ops := make([]*Message, 0)
+	buf := bytes.NewReader(body)
+	for {
+		op, err := ReadMessage(buf)
+		if err == io.EOF {
+			return ops, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.method {
+		case MethodPut, MethodDelete, MethodCheck:
+			ops = append(ops, op)
+		default:
+			return nil, fmt.Errorf("cannot %s in a transaction", op.method)
+		}
+	}
+}
+
+// Update the store with an update from the leader, expanding transactions into
+// the puts and deletes they contain so that they are all written in the state
+// of the transaction or not at all. Watchers are notified of every change;
+// changes to keys outside the subtrees of a partial replica are skipped.
+func (r *Replica) update(msg *Message) error {
+	if msg.method != MethodTxn {
+		if !r.holds(msg.key) {
+			return nil
+		}
+		if err := r.store.Put(msg); err != nil {
+			return err
+		}
+		r.track(msg)
+		r.notify(msg)
+		return nil
+	}
+
+	ops, err := decodeOps(msg.body)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		if op.method == MethodCheck || !r.holds(op.key) {
+			continue
+		}
+
+		change := &Message{
+			method:   op.method,
+			sequence: msg.sequence,
+			term:     msg.term,
+			key:      op.key,
+			body:     op.body,
+		}
+		if err := r.store.Put(change); err != nil {
+			return err
+		}
+		r.track(change)
+		r.notify(change)
+	}
+	return nil
+}
+
+// Handle a Txn request from a client. If every check in the transaction
+// passes, the transaction is published as a single update, otherwise a
+// conflict is returned with the current version of the key that failed.
+func (l *Leader) onTxn(msg *Message, route [][]byte) error {
+	ops, err := decodeOps(msg.body)
+	if err != nil {
+		return l.sendError(l.requests, route, "", protocolErrorf("bad transaction: %s", err))
+	}
+
+	for _, op := range ops {
+		if op.method != MethodCheck {
+			continue
+		}
+
+		if version := l.version(op.key); version != op.sequence {
+			rep := &Message{
+				method:   MethodError,
+				sequence: version,
+				term:     l.term,
+				key:      op.key,
+				body:     []byte(ErrConflict.Error()),
+			}
+			return l.respond(rep, route)
+		}
+	}
+
+	if err := l.publish(msg); err != nil {
+		return err
+	}
+
+	// Respond to the client
+	return l.reply(msg, route)
+}
@@ -0,0 +1,309 @@
+// This file handles durable storage of the key/value store on disk using an
+// append-only write-ahead log that is periodically compacted into a snapshot.
+
+package dolly
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Names of the files in the data directory of a replica.
+const (
+	walFile      = "wal.log"
+	snapshotFile = "snapshot.dat"
+)
+
+// CompactionInterval is the number of updates appended to the write-ahead log
+// before the store is written to a snapshot file and the log is truncated.
+const CompactionInterval = 1024
+
+// Recover the store from the snapshot file and write-ahead log in the data
+// directory of the replica, then open the log to persist further updates.
+// The updates replayed from the log (those after the snapshot) are kept in
+// memory so that other replicas can catch up from them. If the replica has no
+// data directory or has already recovered, does nothing.
+func (r *Replica) Recover() error {
+	if r.Data == "" || r.wal != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(r.Data, 0755); err != nil {
+		return err
+	}
+
+	// Load the compacted snapshot of the store
+	keys, err := r.loadSnapshot()
+	if err != nil {
+		return err
+	}
+
+	// Open the log and replay every update after the snapshot
+	if r.wal, err = openWAL(filepath.Join(r.Data, walFile)); err != nil {
+		return err
+	}
+
+	entries, err := r.wal.replay()
+	if err != nil {
+		return err
+	}
+
+	replayed := 0
+	for _, msg := range entries {
+		if msg.sequence <= r.sequence {
+			continue
+		}
+
+		if err = r.update(msg); err != nil {
+			return err
+		}
+		r.sequence = msg.sequence
+		r.lastTerm = msg.term
+		if msg.term > r.term {
+			r.term = msg.term
+		}
+		r.record(msg)
+		replayed++
+	}
+
+	info("recovered %d keys and %d logged updates up to state %d from %s", keys, replayed, r.sequence, r.Data)
+	return nil
+}
+
+// Persist an applied update to the write-ahead log, compacting the log into a
+// snapshot when enough updates have been appended.
+func (r *Replica) persist(msg *Message) error {
+	if err := r.writeAhead(msg); err != nil {
+		return err
+	}
+	return r.checkpoint()
+}
+
+// Append an update to the write-ahead log, which the leader does before the
+// update is published or applied to the store.
+func (r *Replica) writeAhead(msg *Message) error {
+	if r.wal == nil {
+		return nil
+	}
+	return r.wal.append(msg)
+}
+
+// Compact the write-ahead log into a snapshot when enough updates have been
+// appended. Every update in the log must have been applied to the store, since
+// the log is truncated once the store is written.
+func (r *Replica) checkpoint() error {
+	if r.wal == nil || r.wal.entries < CompactionInterval {
+		return nil
+	}
+	return r.compact()
+}
+
+// Compact writes the entire store to the snapshot file then truncates the
+// write-ahead log since all of its updates are contained in the snapshot. If
+// the store is on disk, it is synced and only its state is written.
+func (r *Replica) compact() error {
+	if r.wal == nil {
+		return nil
+	}
+
+	// Write to a temporary file and move it so the snapshot is never partial
+	path := filepath.Join(r.Data, snapshotFile)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	// The on-disk engine persists its own entries, so only the state is needed
+	var werr error
+	w := bufio.NewWriter(f)
+	if r.durable() {
+		err = r.store.Sync()
+	} else {
+		err = r.store.Iterate("", func(msg *Message) bool {
+			werr = msg.Write(w)
+			return werr == nil
+		})
+	}
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	// Terminate the snapshot with the sequence and terms of the store
+	term := r.mark(&Message{
+		method:   MethodTerm,
+		sequence: r.sequence,
+		term:     r.term,
+		key:      "",
+		body:     nil,
+	})
+	if err = term.Write(w); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	debug("compacted %d keys at state %d", r.store.Len(), r.sequence)
+	return r.wal.truncate()
+}
+
+// Load the snapshot file into the store, returning the number of keys read.
+func (r *Replica) loadSnapshot() (int, error) {
+	f, err := os.Open(filepath.Join(r.Data, snapshotFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	keys := 0
+	reader := bufio.NewReader(f)
+	for {
+		msg, err := ReadMessage(reader)
+		if err != nil {
+			return keys, fmt.Errorf("could not read snapshot: %s", err)
+		}
+
+		// If this is the terminate message then collect sequence
+		if msg.method == MethodTerm {
+			r.sequence = msg.sequence
+			r.term = msg.term
+			r.lastTerm = positionOf(msg).term
+			return keys, nil
+		}
+
+		keys++
+		if err = r.store.Put(msg); err != nil {
+			return keys, err
+		}
+	}
+}
+
+//===========================================================================
+// Write-ahead log
+//===========================================================================
+
+// wal is an append-only log of every update applied to the store.
+type wal struct {
+	file    *os.File // the open log file
+	entries int      // number of entries appended since the last truncation
+}
+
+// Open the write-ahead log at the specified path, creating it if necessary.
+func openWAL(path string) (*wal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &wal{file: file}, nil
+}
+
+// Read every entry in the log from the beginning. If the log ends with a
+// partially written entry, it is truncated to the last complete entry.
+func (w *wal) replay() ([]*Message, error) {
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*Message, 0)
+	reader := &countingReader{r: bufio.NewReader(w.file)}
+
+	var offset int64
+	for {
+		msg, err := ReadMessage(reader)
+		if err == io.EOF {
+			break
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			warn("truncating partial entry at the end of the write-ahead log")
+			if err = w.file.Truncate(offset); err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		offset = reader.n
+		entries = append(entries, msg)
+	}
+
+	// Position the file to append after the last complete entry
+	if _, err := w.file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	w.entries = len(entries)
+	return entries, nil
+}
+
+// Append an entry to the log, syncing it to disk before returning.
+func (w *wal) append(msg *Message) error {
+	buf := bufio.NewWriter(w.file)
+	if err := msg.Write(buf); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+
+	w.entries++
+	return nil
+}
+
+// Truncate the log after its entries have been compacted into a snapshot.
+func (w *wal) truncate() error {
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	w.entries = 0
+	return w.file.Sync()
+}
+
+// countingReader tracks the number of bytes read so that replay can find the
+// offset of the last complete entry in the log.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,358 @@
+package dolly
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Create a temporary data directory, returning a function that removes it.
+func makeDataDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "dolly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// Create a replica with a memory store in a temporary data directory.
+func makeDurableReplica(t *testing.T) (*Replica, func()) {
+	dir, cleanup := makeDataDir(t)
+	r := &Replica{Name: "alpha", Data: dir, store: newMemoryStore()}
+	return r, func() {
+		if r.wal != nil {
+			r.wal.file.Close()
+		}
+		cleanup()
+	}
+}
+
+// Put a value of the key written at the sequence directly into the store.
+func putValue(t *testing.T, s Store, sequence uint64, key, value string) {
+	msg := &Message{method: MethodPut, sequence: sequence, term: 1, key: key, body: []byte(value)}
+	if err := s.Put(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Apply and persist a put of the key at the next state of the replica.
+func putDurable(t *testing.T, r *Replica, key, value string) {
+	msg := &Message{method: MethodPut, sequence: r.sequence + 1, term: 1, key: key, body: []byte(value)}
+	if err := r.update(msg); err != nil {
+		t.Fatal(err)
+	}
+	r.sequence = msg.sequence
+	r.lastTerm = msg.term
+	r.record(msg)
+	if err := r.persist(msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Recover a new replica from the data directory of the replica.
+func recoverReplica(t *testing.T, r *Replica) *Replica {
+	r.wal.file.Close()
+	r.wal = nil
+
+	recovered := &Replica{Name: r.Name, Data: r.Data, store: newMemoryStore()}
+	if err := recovered.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	return recovered
+}
+
+// Check that the store holds the value of the key.
+func checkValue(t *testing.T, s Store, key, value string) {
+	msg, ok := s.Get(key)
+	if !ok {
+		t.Fatalf("key %q is not in the store", key)
+	}
+	if string(msg.body) != value {
+		t.Fatalf("expected %q=%q, got %q", key, value, msg.body)
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg := &Message{method: MethodPut, sequence: 42, term: 7, key: "foo", body: []byte("bar")}
+	msg.set(optLease, "12")
+
+	buf := new(bytes.Buffer)
+	if err := msg.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := ReadMessage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if read.method != msg.method || read.sequence != msg.sequence || read.term != msg.term || read.key != msg.key || !bytes.Equal(read.body, msg.body) {
+		t.Errorf("expected %+v, read %+v", msg, read)
+	}
+	if read.options.Get(optLease) != "12" {
+		t.Errorf("expected lease option to be read, got %q", read.options.Encode())
+	}
+
+	if _, err = ReadMessage(buf); err != io.EOF {
+		t.Errorf("expected io.EOF after the last message, got %v", err)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	r, cleanup := makeDurableReplica(t)
+	defer cleanup()
+
+	if err := r.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	putDurable(t, r, "a", "1")
+	putDurable(t, r, "b", "2")
+	putDurable(t, r, "a", "3")
+
+	r = recoverReplica(t, r)
+	if r.sequence != 3 || r.lastTerm != 1 {
+		t.Errorf("expected state 3 in term 1, got %d in term %d", r.sequence, r.lastTerm)
+	}
+	if len(r.log) != 3 {
+		t.Errorf("expected 3 updates in the log, got %d", len(r.log))
+	}
+	checkValue(t, r.store, "a", "3")
+	checkValue(t, r.store, "b", "2")
+}
+
+func TestWALTruncatedTail(t *testing.T) {
+	r, cleanup := makeDurableReplica(t)
+	defer cleanup()
+
+	if err := r.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	putDurable(t, r, "a", "1")
+	putDurable(t, r, "b", "2")
+
+	info, err := r.wal.file.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := info.Size()
+
+	// Write half of an entry as if the replica crashed while appending it
+	buf := new(bytes.Buffer)
+	partial := &Message{method: MethodPut, sequence: 3, term: 1, key: "c", body: []byte("3")}
+	if err = partial.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.wal.file.Write(buf.Bytes()[:buf.Len()/2]); err != nil {
+		t.Fatal(err)
+	}
+
+	r = recoverReplica(t, r)
+	if r.sequence != 2 {
+		t.Errorf("expected state 2 without the partial entry, got %d", r.sequence)
+	}
+	if _, ok := r.store.Get("c"); ok {
+		t.Error("partial entry was applied to the store")
+	}
+
+	if info, err = os.Stat(filepath.Join(r.Data, walFile)); err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != complete {
+		t.Errorf("expected log to be truncated to %d bytes, got %d", complete, info.Size())
+	}
+
+	// Entries appended after the truncation must be replayed
+	putDurable(t, r, "c", "4")
+	r = recoverReplica(t, r)
+	if r.sequence != 3 {
+		t.Errorf("expected state 3, got %d", r.sequence)
+	}
+	checkValue(t, r.store, "c", "4")
+}
+
+func TestWALCompaction(t *testing.T) {
+	r, cleanup := makeDurableReplica(t)
+	defer cleanup()
+
+	if err := r.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	putDurable(t, r, "a", "1")
+	putDurable(t, r, "b", "2")
+	if err := r.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if r.wal.entries != 0 {
+		t.Errorf("expected log to be empty after compaction, has %d entries", r.wal.entries)
+	}
+
+	putDurable(t, r, "a", "3")
+	putDurable(t, r, "c", "4")
+
+	r = recoverReplica(t, r)
+	if r.sequence != 4 || r.lastTerm != 1 {
+		t.Errorf("expected state 4 in term 1, got %d in term %d", r.sequence, r.lastTerm)
+	}
+	if len(r.log) != 2 {
+		t.Errorf("expected only the 2 updates after the snapshot in the log, got %d", len(r.log))
+	}
+	checkValue(t, r.store, "a", "3")
+	checkValue(t, r.store, "b", "2")
+	checkValue(t, r.store, "c", "4")
+}
+
+func TestWALSkipsCompactedEntries(t *testing.T) {
+	r, cleanup := makeDurableReplica(t)
+	defer cleanup()
+
+	if err := r.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	putDurable(t, r, "a", "1")
+	putDurable(t, r, "a", "2")
+	putDurable(t, r, "b", "3")
+
+	// Write the snapshot without truncating the log, as if the replica
+	// crashed between compacting the store and truncating the log
+	path := filepath.Join(r.Data, walFile)
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, saved, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.wal.file.Seek(0, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+
+	putDurable(t, r, "c", "4")
+
+	r = recoverReplica(t, r)
+	if r.sequence != 4 {
+		t.Errorf("expected state 4, got %d", r.sequence)
+	}
+	if len(r.log) != 1 || r.log[0].sequence != 4 {
+		t.Errorf("expected only state 4 to be replayed, log has %d updates", len(r.log))
+	}
+	checkValue(t, r.store, "a", "2")
+	checkValue(t, r.store, "b", "3")
+	checkValue(t, r.store, "c", "4")
+}
+
+func TestLeaderWALCompaction(t *testing.T) {
+	r, cleanup := makeDurableReplica(t)
+	defer cleanup()
+
+	if err := r.Recover(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sequence and apply updates as the leader publishes them until the log
+	// is compacted by the last one
+	l := &Leader{Replica: r}
+	l.term = 1
+	for i := 0; i < CompactionInterval; i++ {
+		msg := &Message{method: MethodPut, key: fmt.Sprintf("key%d", i), body: []byte("value")}
+		if err := l.sequenceUpdate(msg); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.applyUpdate(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.wal.entries != 0 {
+		t.Errorf("expected log to be compacted, has %d entries", r.wal.entries)
+	}
+
+	r = recoverReplica(t, r)
+	if r.sequence != CompactionInterval || r.store.Len() != CompactionInterval {
+		t.Errorf("expected %d keys at state %d, got %d at %d", CompactionInterval, CompactionInterval, r.store.Len(), r.sequence)
+	}
+	checkValue(t, r.store, fmt.Sprintf("key%d", CompactionInterval-1), "value")
+}
+
+func TestReadMessageLimits(t *testing.T) {
+	// A length prefix claiming more bytes than the body holds
+	body := []byte{0xff, 0xff, 0xff, 0x00, 'P', 'u', 't'}
+	if _, err := ReadMessage(bytes.NewReader(body)); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	// A length prefix larger than the maximum from a reader of unknown length
+	body = []byte{0xff, 0xff, 0xff, 0xff}
+	if _, err := ReadMessage(io.MultiReader(bytes.NewReader(body))); err == nil {
+		t.Error("expected an error for a part larger than the maximum")
+	}
+}
+
+func TestLeaderRejectsLargeParts(t *testing.T) {
+	l := &Leader{Replica: &Replica{Name: "alpha", network: &Network{}, store: newMemoryStore()}}
+
+	msg := &Message{method: MethodPut, key: "a", body: make([]byte, MaxPartSize+1)}
+	if err := l.validate(msg); err != ErrTooLarge {
+		t.Errorf("expected a put larger than the maximum to be refused, got %v", err)
+	}
+
+	msg.body = msg.body[:MaxPartSize]
+	if err := l.validate(msg); err != nil {
+		t.Errorf("expected a put of the maximum size to be accepted, got %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := msg.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMessage(buf); err != nil {
+		t.Errorf("expected a put of the maximum size to be read back, got %v", err)
+	}
+}
+
+func TestDeltaInstallPersisted(t *testing.T) {
+	r, cleanup := makeDurableReplica(t)
+	defer cleanup()
+
+	if err := r.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	putDurable(t, r, "a", "1")
+	if err := r.indexTombstones(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Install the deltas after the state of the replica from the leader
+	dl := &download{entries: []*Message{
+		{method: MethodPut, sequence: 2, term: 1, key: "b", body: []byte("2")},
+		{method: MethodDelete, sequence: 3, term: 1, key: "a"},
+	}}
+	term := &Message{method: MethodTerm, sequence: 3, term: 1}
+	term.set(optDelta, "true")
+	term.set(optLastTerm, "1")
+	if err := r.install(dl, term); err != nil {
+		t.Fatal(err)
+	}
+	if seq, ok := r.deleted["a"]; !ok || seq != 3 {
+		t.Errorf("expected the deleted key to be tracked at state 3, got %d", seq)
+	}
+
+	// The deltas are recovered from the log without a compaction
+	r = recoverReplica(t, r)
+	if r.sequence != 3 {
+		t.Errorf("expected state 3, got %d", r.sequence)
+	}
+	checkValue(t, r.store, "b", "2")
+	if val, ok := r.store.Get("a"); !ok || val.method != MethodDelete {
+		t.Error("expected the tombstone of the deleted key to be recovered")
+	}
+}
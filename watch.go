@@ -0,0 +1,276 @@
+// This file implements streaming of changes to the keys in the store to
+// clients that watch a prefix of the key space.
+
+package dolly
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	zmq "github.com/pebbe/zmq4"
+)
+
+// Event is a change to a key that is streamed to a watcher.
+type Event struct {
+	Method  string  // either MethodPut or MethodDelete
+	Key     string  // the key that was changed
+	Value   []byte  // the value that was put, nil if deleted
+	Version Version // the state in which the key was changed
+}
+
+// watcher is a client session that is streamed the changes of a prefix.
+type watcher struct {
+	route   [][]byte  // the route to send events to the client on
+	prefix  string    // the prefix of the keys the client is watching
+	renewed time.Time // the last time the client renewed the session
+}
+
+// Returns a key that identifies the client that sent a message on the route.
+func routeKey(route [][]byte) string {
+	parts := make([]string, len(route))
+	for i, identity := range route {
+		parts[i] = string(identity)
+	}
+	return strings.Join(parts, "\x00")
+}
+
+//===========================================================================
+// Replica watch handlers
+//===========================================================================
+
+// Handle a Watch request from a client for the prefix in the key of the
+// request. Starts a session that replays every change in the store after the
+// sequence of the request then streams live changes. Clients renew the session
+// by sending the request again, otherwise it expires after the election timeout.
+func (r *Replica) onWatch(msg *Message, route [][]byte) error {
+	if r.watchers == nil {
+		r.watchers = make(map[string]*watcher)
+	}
+
+	if !r.holds(msg.key) {
+		return r.sendError(r.requests, route, msg.key, ErrNotReplicated)
+	}
+
+	id := routeKey(route)
+	if w, ok := r.watchers[id]; ok {
+		w.renewed = time.Now()
+		return nil
+	}
+
+	w := &watcher{route: route, prefix: msg.key, renewed: time.Now()}
+	r.watchers[id] = w
+
+	// Replay the latest change of every key in the prefix in sequence order;
+	// deletes are only replayed if their tombstones have not been collected.
+	changes := make([]*Message, 0)
+	if err := r.store.Iterate(w.prefix, func(val *Message) bool {
+		if !strings.HasPrefix(val.key, w.prefix) {
+			return false
+		}
+		if val.sequence > msg.sequence {
+			changes = append(changes, val)
+		}
+		return true
+	}); err != nil {
+		delete(r.watchers, id)
+		return r.sendError(r.requests, route, msg.key, err)
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].sequence < changes[j].sequence })
+
+	for _, change := range changes {
+		if err := change.Send(r.requests, w.route); err != nil {
+			return err
+		}
+	}
+
+	info("watching %q for client from state %d, replayed %d changes", w.prefix, msg.sequence, len(changes))
+	return nil
+}
+
+// Handle an Unwatch request from a client, ending its session.
+func (r *Replica) onUnwatch(msg *Message, route [][]byte) error {
+	delete(r.watchers, routeKey(route))
+	return nil
+}
+
+// Send a change to every watcher of the prefix of the key of the change.
+func (r *Replica) notify(change *Message) {
+	for id, w := range r.watchers {
+		if !strings.HasPrefix(change.key, w.prefix) {
+			continue
+		}
+
+		if err := change.Send(r.requests, w.route); err != nil {
+			warn("could not stream change to watcher: %s", err)
+			delete(r.watchers, id)
+		}
+	}
+}
+
+// Remove the sessions of watchers that have not renewed them.
+func (r *Replica) expireWatchers() {
+	for id, w := range r.watchers {
+		if time.Since(w.renewed) > ElectionTimeout {
+			debug("watch session on %q expired", w.prefix)
+			delete(r.watchers, id)
+		}
+	}
+}
+
+//===========================================================================
+// Client watch requests
+//===========================================================================
+
+// Watch the keys with the specified prefix, returning a channel of the changes
+// made to them after the specified version. The changes before the watch
+// began are replayed first (only the latest change to each key), then every
+// change is streamed as it is applied by the replica. The channel is closed
+// when the context is done or if the watch fails.
+func (c *Client) Watch(ctx context.Context, prefix string, from Version) (<-chan *Event, error) {
+	// Watches are streamed on their own socket so that replies to other
+	// requests are not interleaved with the events.
+	sock, err := c.context.NewSocket(zmq.DEALER)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = sock.SetLinger(0); err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	if err = c.curve(sock); err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	if err = sock.Connect(c.endpoint()); err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	req := &Message{
+		method:   MethodWatch,
+		sequence: uint64(from),
+		key:      prefix,
+		body:     nil,
+	}
+
+	if err = req.Send(sock, nil); err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	events := make(chan *Event, 64)
+	go c.stream(ctx, sock, req, events)
+	return events, nil
+}
+
+// Stream events from the socket onto the channel, renewing the watch session
+// every heartbeat interval until the context is done. Sessions are renewed on
+// a timer even while the consumer is slow to receive events, and each renewal
+// asks for the changes from the version of the last event delivered so that a
+// session that did expire replays the rest of the changes of a transaction,
+// which share its version. Replayed events that are older than an event
+// already received, or that were already received at the same version, are
+// dropped.
+func (c *Client) stream(ctx context.Context, sock *zmq.Socket, req *Message, events chan<- *Event) {
+	defer close(events)
+	defer sock.Close()
+
+	poller := zmq.NewPoller()
+	poller.Add(sock, zmq.POLLIN)
+
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+
+	// The latest version received and the keys received at that version
+	var received uint64
+	seen := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			c.unwatch(sock, req)
+			return
+		case <-ticker.C:
+			if err := req.Send(sock, nil); err != nil {
+				debug("could not renew watch: %s", err)
+				return
+			}
+		default:
+		}
+
+		items, err := poller.Poll(pollInterval)
+		if err != nil {
+			debug("could not poll watch: %s", err)
+			return
+		}
+
+		if len(items) == 0 {
+			continue
+		}
+
+		msg, _, err := RecvMessage(sock, false)
+		if err != nil {
+			debug("could not receive watch: %s", err)
+			return
+		}
+
+		if msg.method == MethodError {
+			debug("watch failed: %s", msg.body)
+			return
+		}
+
+		if msg.sequence < received || (msg.sequence == received && seen[msg.key]) {
+			continue
+		}
+		if msg.sequence > received {
+			received = msg.sequence
+			seen = make(map[string]bool)
+		}
+		seen[msg.key] = true
+
+		event := &Event{
+			Method:  msg.method,
+			Key:     msg.key,
+			Value:   msg.body,
+			Version: Version(msg.sequence),
+		}
+		if event.Method == MethodDelete {
+			event.Value = nil
+		}
+
+		// Keep renewing the session while waiting for the consumer
+		for delivered := false; !delivered; {
+			select {
+			case events <- event:
+				delivered = true
+				req.sequence = msg.sequence - 1
+			case <-ticker.C:
+				if err := req.Send(sock, nil); err != nil {
+					debug("could not renew watch: %s", err)
+					return
+				}
+			case <-ctx.Done():
+				c.unwatch(sock, req)
+				return
+			}
+		}
+	}
+}
+
+// End the watch session on the replica.
+func (c *Client) unwatch(sock *zmq.Socket, req *Message) {
+	req.method = MethodUnwatch
+	req.Send(sock, nil)
+}
+
+// Watch the keys with the specified prefix on the next replica. See
+// Client.Watch for details.
+func (c *Cluster) Watch(ctx context.Context, prefix string, from Version) (<-chan *Event, error) {
+	client := c.clients[c.next]
+	c.next = (c.next + 1) % len(c.clients)
+	return client.Watch(ctx, prefix, from)
+}